@@ -0,0 +1,104 @@
+package saml
+
+import (
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/xml"
+	"net/url"
+	"time"
+)
+
+// ProtocolBindingHTTPPOST is the URI for the SAML HTTP-POST binding, used as
+// an AuthnRequest's ProtocolBinding to tell the IdP how to deliver its
+// response.
+const ProtocolBindingHTTPPOST = "urn:oasis:names:tc:SAML:2.0:bindings:HTTP-POST"
+
+// AuthnRequest represents a SAML authentication request, sent by a service
+// provider to an identity provider to initiate a login (the "SP-initiated"
+// flow).
+//
+// Use NewAuthnRequest to construct one, and BuildRedirectURL or
+// BuildPOSTForm to encode it for delivery to an IdP.
+type AuthnRequest struct {
+	XMLName                     xml.Name  `xml:"urn:oasis:names:tc:SAML:2.0:protocol AuthnRequest"`
+	ID                          string    `xml:"ID,attr"`
+	Version                     string    `xml:"Version,attr"`
+	IssueInstant                time.Time `xml:"IssueInstant,attr"`
+	Destination                 string    `xml:"Destination,attr,omitempty"`
+	AssertionConsumerServiceURL string    `xml:"AssertionConsumerServiceURL,attr,omitempty"`
+	ProtocolBinding             string    `xml:"ProtocolBinding,attr,omitempty"`
+	Issuer                      Issuer    `xml:"Issuer"`
+}
+
+// NewAuthnRequest builds an AuthnRequest with a fresh, random ID (suitable
+// for later use as VerifyOptions.ExpectedRequestID), IssueInstant set to now,
+// and ProtocolBinding set to HTTP-POST (the binding this package's Verify
+// expects the IdP to use when returning its response).
+//
+// issuer is this service provider's entity ID. acsURL is where the IdP
+// should deliver its response. destination is the IdP's SSO endpoint, i.e.
+// where this AuthnRequest itself is being sent.
+func NewAuthnRequest(issuer, acsURL, destination string) (AuthnRequest, error) {
+	id, err := NewRequestID()
+	if err != nil {
+		return AuthnRequest{}, err
+	}
+
+	return AuthnRequest{
+		ID:                          id,
+		Version:                     "2.0",
+		IssueInstant:                time.Now().UTC(),
+		Destination:                 destination,
+		AssertionConsumerServiceURL: acsURL,
+		ProtocolBinding:             ProtocolBindingHTTPPOST,
+		Issuer:                      Issuer{Name: issuer},
+	}, nil
+}
+
+// BuildRedirectURL encodes req for delivery to idpSSO via the SAML 2.0
+// HTTP-Redirect binding: req is marshaled to XML, DEFLATE-compressed (raw
+// deflate, with no zlib or gzip header, per SAML 2.0 Bindings section
+// 3.4.4.1), base64-encoded, and set as the SAMLRequest query parameter,
+// alongside relayState as RelayState.
+//
+// It returns the URL the user's browser should be redirected to, and req's
+// ID, which the caller should stash (e.g. in a signed cookie) and later pass
+// as VerifyOptions.ExpectedRequestID.
+func BuildRedirectURL(idpSSO *url.URL, req AuthnRequest, relayState string) (*url.URL, string, error) {
+	return buildAuthnRequestRedirectURL(idpSSO, req, relayState, nil)
+}
+
+// BuildSignedRedirectURL is like BuildRedirectURL, but additionally signs the
+// request per the HTTP-Redirect binding's signing rules: the octet string
+// "SAMLRequest=<value>&RelayState=<value>&SigAlg=<value>" (RelayState
+// omitted if empty) is signed with key using RSA-SHA256, and the result is
+// appended as a base64-encoded Signature query parameter.
+func BuildSignedRedirectURL(idpSSO *url.URL, req AuthnRequest, relayState string, key *rsa.PrivateKey) (*url.URL, string, error) {
+	return buildAuthnRequestRedirectURL(idpSSO, req, relayState, key)
+}
+
+func buildAuthnRequestRedirectURL(idpSSO *url.URL, req AuthnRequest, relayState string, key *rsa.PrivateKey) (*url.URL, string, error) {
+	result, err := buildRedirectBindingURL(idpSSO, ParamSAMLRequest, req, relayState, key)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return result, req.ID, nil
+}
+
+// BuildPOSTForm encodes req for delivery to an IdP via the SAML 2.0
+// HTTP-POST binding: req is marshaled to XML and base64-encoded (per the
+// POST binding, unlike HTTP-Redirect, this is not also DEFLATE-compressed).
+//
+// It returns the value to use for the form's SAMLRequest field, and req's ID
+// for the caller to stash, as with BuildRedirectURL. The caller is
+// responsible for rendering an HTML form that auto-submits SAMLRequest (and
+// relayState, as RelayState) to the IdP's SSO endpoint.
+func BuildPOSTForm(req AuthnRequest) (samlRequest string, requestID string, err error) {
+	data, err := xml.Marshal(req)
+	if err != nil {
+		return "", "", err
+	}
+
+	return base64.StdEncoding.EncodeToString(data), req.ID, nil
+}
@@ -0,0 +1,47 @@
+package saml
+
+import (
+	"encoding/xml"
+	"net/url"
+	"testing"
+)
+
+type testBindingMessage struct {
+	XMLName xml.Name `xml:"TestMessage"`
+	Value   string   `xml:"Value"`
+}
+
+func TestRedirectBindingRoundTrip(t *testing.T) {
+	endpoint, err := url.Parse("https://idp.example.com/sso")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg := testBindingMessage{Value: "hello, world"}
+
+	result, err := buildRedirectBindingURL(endpoint, ParamSAMLRequest, msg, "some-relay-state", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	query := result.Query()
+	if query.Get("RelayState") != "some-relay-state" {
+		t.Fatalf("RelayState = %q, want %q", query.Get("RelayState"), "some-relay-state")
+	}
+
+	var got testBindingMessage
+	if _, err := decodeRedirectBindingMessage(query.Get(ParamSAMLRequest), &got); err != nil {
+		t.Fatal(err)
+	}
+
+	if got.Value != msg.Value {
+		t.Errorf("got.Value = %q, want %q", got.Value, msg.Value)
+	}
+}
+
+func TestDecodeRedirectBindingMessageMalformed(t *testing.T) {
+	var got testBindingMessage
+	if _, err := decodeRedirectBindingMessage("not valid base64!!!", &got); err == nil {
+		t.Fatal("expected error for malformed base64, got nil")
+	}
+}
@@ -2,43 +2,166 @@ package main
 
 import (
 	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
 	"crypto/x509"
+	"crypto/x509/pkix"
 	"database/sql"
+	"encoding/hex"
 	"encoding/pem"
 	"encoding/xml"
 	"errors"
 	"fmt"
 	"html/template"
+	"math/big"
 	"net/http"
+	"net/url"
+	"strings"
 	"time"
 
 	"github.com/google/uuid"
 	"github.com/jmoiron/sqlx"
 	"github.com/julienschmidt/httprouter"
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
 	"github.com/ucarion/saml"
 	"golang.org/x/crypto/bcrypt"
 )
 
+// relayStateKey signs the saml_relay_state cookie, so that a forged or
+// tampered cookie can't be used to smuggle a stale RelayState past the ACS
+// handler's comparison below. It's generated fresh on every process start,
+// so logins in flight across a restart simply have to be retried.
+var relayStateKey = func() []byte {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		panic(err)
+	}
+
+	return key
+}()
+
+// signRelayState authenticates value with relayStateKey, for storage in the
+// saml_relay_state cookie.
+func signRelayState(value string) string {
+	mac := hmac.New(sha256.New, relayStateKey)
+	mac.Write([]byte(value))
+	return value + "." + hex.EncodeToString(mac.Sum(nil))
+}
+
+// verifyRelayState reverses signRelayState, returning the original value and
+// true if signed is a validly-signed value, or "", false otherwise.
+func verifyRelayState(signed string) (string, bool) {
+	i := strings.LastIndex(signed, ".")
+	if i < 0 {
+		return "", false
+	}
+
+	value, signature := signed[:i], signed[i+1:]
+
+	mac := hmac.New(sha256.New, relayStateKey)
+	mac.Write([]byte(value))
+	expectedSignature := hex.EncodeToString(mac.Sum(nil))
+
+	if subtle.ConstantTimeCompare([]byte(signature), []byte(expectedSignature)) != 1 {
+		return "", false
+	}
+
+	return value, true
+}
+
+// generateSPKeypair creates a fresh RSA key pair for an account to use to
+// decrypt IdP-encrypted assertions, PEM/PKCS1-encoding the private key for
+// storage in accounts.saml_sp_private_key.
+func generateSPKeypair() ([]byte, error) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, err
+	}
+
+	return pem.EncodeToMemory(&pem.Block{
+		Type:  "RSA PRIVATE KEY",
+		Bytes: x509.MarshalPKCS1PrivateKey(key),
+	}), nil
+}
+
+// parseSPPrivateKey reverses generateSPKeypair's encoding.
+func parseSPPrivateKey(data []byte) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("saml-todo-app: no PEM block in saml_sp_private_key")
+	}
+
+	return x509.ParsePKCS1PrivateKey(block.Bytes)
+}
+
+// selfSignedSPCert wraps key's public half in a self-signed certificate, for
+// advertising in this SP's metadata. SAML doesn't validate a certificate
+// chain: IdPs only care about the public key it carries.
+func selfSignedSPCert(key *rsa.PrivateKey, commonName string) (*x509.Certificate, error) {
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().AddDate(10, 0, 0),
+	}
+
+	data, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+
+	return x509.ParseCertificate(data)
+}
+
 type account struct {
-	ID              uuid.UUID `db:"id"`
-	SAMLIssuer      *string   `db:"saml_issuer"`
-	SAMLX509        []byte    `db:"saml_x509"`
-	SAMLRedirectURL *string   `db:"saml_redirect_url"`
+	ID                       uuid.UUID      `db:"id"`
+	SAMLIssuer               *string        `db:"saml_issuer"`
+	SAMLX509                 []byte         `db:"saml_x509"`
+	SAMLRedirectURL          *string        `db:"saml_redirect_url"`
+	SAMLSLOURL               *string        `db:"saml_slo_url"`
+	SAMLSPPrivateKey         []byte         `db:"saml_sp_private_key"`
+	SAMLEmailAttribute       *string        `db:"saml_email_attribute"`
+	SAMLDisplayNameAttribute *string        `db:"saml_display_name_attribute"`
+	SAMLGroupsAttribute      *string        `db:"saml_groups_attribute"`
+	SAMLProvisioningMode     string         `db:"saml_provisioning_mode"`
+	SAMLAllowedGroups        pq.StringArray `db:"saml_allowed_groups"`
 }
 
+// SAML provisioning modes, controlling how an account handles a user logging
+// in via SAML for the first time, and whether their profile is kept in sync
+// on subsequent logins.
+const (
+	// ProvisioningModeJIT creates a new user the first time they log in via
+	// SAML, but never updates an existing user's profile afterward.
+	ProvisioningModeJIT = "jit"
+
+	// ProvisioningModeJITUpdate is like ProvisioningModeJIT, but also
+	// updates an existing user's display name and groups on every login.
+	ProvisioningModeJITUpdate = "jit_update"
+
+	// ProvisioningModeStrict never creates a user: a SAML login for an email
+	// address with no existing user is rejected.
+	ProvisioningModeStrict = "strict"
+)
+
 type user struct {
-	ID           uuid.UUID `db:"id"`
-	AccountID    uuid.UUID `db:"account_id"`
-	SAMLID       *string   `db:"saml_id"`
-	DisplayName  string    `db:"display_name"`
-	PasswordHash []byte    `db:"password_hash"`
+	ID           uuid.UUID      `db:"id"`
+	AccountID    uuid.UUID      `db:"account_id"`
+	SAMLID       *string        `db:"saml_id"`
+	Email        *string        `db:"email"`
+	DisplayName  string         `db:"display_name"`
+	Groups       pq.StringArray `db:"groups"`
+	PasswordHash []byte         `db:"password_hash"`
 }
 
 type session struct {
-	ID        uuid.UUID `db:"id"`
-	UserID    uuid.UUID `db:"user_id"`
-	ExpiresAt time.Time `db:"expires_at"`
+	ID               uuid.UUID `db:"id"`
+	UserID           uuid.UUID `db:"user_id"`
+	ExpiresAt        time.Time `db:"expires_at"`
+	SAMLSessionIndex *string   `db:"saml_session_index"`
 }
 
 type todo struct {
@@ -55,7 +178,9 @@ func (s *store) getAccount(ctx context.Context, id uuid.UUID) (account, error) {
 	var a account
 	err := s.DB.GetContext(ctx, &a, `
 		select
-			id, saml_issuer, saml_x509, saml_redirect_url
+			id, saml_issuer, saml_x509, saml_redirect_url, saml_slo_url, saml_sp_private_key,
+			saml_email_attribute, saml_display_name_attribute, saml_groups_attribute,
+			saml_provisioning_mode, saml_allowed_groups
 		from
 			accounts
 		where
@@ -76,10 +201,33 @@ func (s *store) updateAccount(ctx context.Context, a account) error {
 		set
 			saml_issuer = $1,
 			saml_x509 = $2,
-			saml_redirect_url = $3
+			saml_redirect_url = $3,
+			saml_slo_url = $4
 		where
-			id = $4
-	`, a.SAMLIssuer, a.SAMLX509, a.SAMLRedirectURL, a.ID)
+			id = $5
+	`, a.SAMLIssuer, a.SAMLX509, a.SAMLRedirectURL, a.SAMLSLOURL, a.ID)
+	return err
+}
+
+func (s *store) updateAccountSPPrivateKey(ctx context.Context, id uuid.UUID, key []byte) error {
+	_, err := s.DB.ExecContext(ctx, `
+		update accounts set saml_sp_private_key = $1 where id = $2
+	`, key, id)
+	return err
+}
+
+// updateAccountSAMLConfig persists how this account maps IdP attributes onto
+// a user's identity, and how it provisions users on SAML login.
+func (s *store) updateAccountSAMLConfig(ctx context.Context, id uuid.UUID, emailAttr, displayNameAttr, groupsAttr *string, provisioningMode string, allowedGroups []string) error {
+	_, err := s.DB.ExecContext(ctx, `
+		update accounts set
+			saml_email_attribute = $1,
+			saml_display_name_attribute = $2,
+			saml_groups_attribute = $3,
+			saml_provisioning_mode = $4,
+			saml_allowed_groups = $5
+		where id = $6
+	`, emailAttr, displayNameAttr, groupsAttr, provisioningMode, pq.StringArray(allowedGroups), id)
 	return err
 }
 
@@ -87,7 +235,7 @@ func (s *store) listUsers(ctx context.Context, accountID uuid.UUID) ([]user, err
 	var users []user
 	err := s.DB.SelectContext(ctx, &users, `
 		select
-			id, account_id, display_name, password_hash
+			id, account_id, email, display_name, groups, password_hash
 		from
 			users
 		where
@@ -100,7 +248,7 @@ func (s *store) getUser(ctx context.Context, id uuid.UUID) (user, error) {
 	var u user
 	err := s.DB.GetContext(ctx, &u, `
 		select
-			id, account_id, saml_id, display_name, password_hash
+			id, account_id, saml_id, email, display_name, groups, password_hash
 		from
 			users
 		where
@@ -113,7 +261,7 @@ func (s *store) getUserBySAMLID(ctx context.Context, accountID uuid.UUID, samlID
 	var u user
 	err := s.DB.GetContext(ctx, &u, `
 		select
-			id, account_id, saml_id, display_name, password_hash
+			id, account_id, saml_id, email, display_name, groups, password_hash
 		from
 			users
 		where
@@ -122,23 +270,54 @@ func (s *store) getUserBySAMLID(ctx context.Context, accountID uuid.UUID, samlID
 	return u, err
 }
 
+// getUserByEmail looks up a user by their mapped email attribute, so a
+// SAML login can be matched to a user that was originally created with a
+// password, and "upgraded" to SAML by setting their saml_id below.
+func (s *store) getUserByEmail(ctx context.Context, accountID uuid.UUID, email string) (user, error) {
+	var u user
+	err := s.DB.GetContext(ctx, &u, `
+		select
+			id, account_id, saml_id, email, display_name, groups, password_hash
+		from
+			users
+		where
+			account_id = $1 and email = $2
+	`, accountID, email)
+	return u, err
+}
+
 func (s *store) createUser(ctx context.Context, u user) error {
 	_, err := s.DB.ExecContext(ctx, `
 		insert into users
-			(id, account_id, saml_id, display_name, password_hash)
+			(id, account_id, saml_id, email, display_name, groups, password_hash)
 		values
-			($1, $2, $3, $4, $5)
-	`, u.ID, u.AccountID, u.SAMLID, u.DisplayName, u.PasswordHash)
+			($1, $2, $3, $4, $5, $6, $7)
+	`, u.ID, u.AccountID, u.SAMLID, u.Email, u.DisplayName, u.Groups, u.PasswordHash)
+	return err
+}
+
+// updateUserSAMLProfile sets a user's saml_id, display name and groups from
+// the latest assertion. The ACS handler calls it when upgrading a user to
+// SAML on their first SAML login, and on every login under
+// ProvisioningModeJITUpdate.
+func (s *store) updateUserSAMLProfile(ctx context.Context, id uuid.UUID, samlID string, displayName string, groups []string) error {
+	_, err := s.DB.ExecContext(ctx, `
+		update users set
+			saml_id = $1,
+			display_name = $2,
+			groups = $3
+		where id = $4
+	`, samlID, displayName, pq.StringArray(groups), id)
 	return err
 }
 
 func (s *store) createSession(ctx context.Context, sess session) error {
 	_, err := s.DB.ExecContext(ctx, `
 		insert into sessions
-			(id, user_id, expires_at)
+			(id, user_id, expires_at, saml_session_index)
 		values
-			($1, $2, $3)
-	`, sess.ID, sess.UserID, sess.ExpiresAt)
+			($1, $2, $3, $4)
+	`, sess.ID, sess.UserID, sess.ExpiresAt, sess.SAMLSessionIndex)
 	return err
 }
 
@@ -146,7 +325,7 @@ func (s *store) getSession(ctx context.Context, id uuid.UUID) (session, error) {
 	var sess session
 	err := s.DB.GetContext(ctx, &sess, `
 		select
-			id, user_id, expires_at
+			id, user_id, expires_at, saml_session_index
 		from
 			sessions
 		where
@@ -155,6 +334,27 @@ func (s *store) getSession(ctx context.Context, id uuid.UUID) (session, error) {
 	return sess, err
 }
 
+func (s *store) deleteSession(ctx context.Context, id uuid.UUID) error {
+	_, err := s.DB.ExecContext(ctx, `delete from sessions where id = $1`, id)
+	return err
+}
+
+// deleteSessionsBySAMLSessionIndex deletes every session tied to the given
+// IdP SessionIndex, for a given account's users. It's used to honor an
+// IdP-initiated LogoutRequest, which identifies sessions by SessionIndex
+// rather than by our own session IDs.
+func (s *store) deleteSessionsBySAMLSessionIndex(ctx context.Context, accountID uuid.UUID, sessionIndex string) error {
+	_, err := s.DB.ExecContext(ctx, `
+		delete from sessions
+		using users
+		where
+			sessions.user_id = users.id and
+			users.account_id = $1 and
+			sessions.saml_session_index = $2
+	`, accountID, sessionIndex)
+	return err
+}
+
 func (s *store) listTodos(ctx context.Context, accountID uuid.UUID) ([]todo, error) {
 	var todos []todo
 	err := s.DB.SelectContext(ctx, &todos, `
@@ -237,6 +437,12 @@ var getAccountTemplate = template.Must(template.New("get_account").Parse(`
 	<p>Account ID {{ .ID }}</p>
 
 	<a href="/accounts/{{ .ID }}/saml/initiate">Initiate SAML Login Flow</a>
+	<a href="/accounts/{{ .ID }}/saml/slo/initiate">Log Out (SAML Single Logout)</a>
+	<a href="/accounts/{{ .ID }}/saml/metadata">Download SP Metadata</a>
+
+	<form action="/accounts/{{ .ID }}/saml/sp-key/generate" method="post">
+		<button>Generate SP Keypair (for decrypting encrypted assertions)</button>
+	</form>
 
 	<p>SAML Connnection Details</p>
 
@@ -275,6 +481,20 @@ var getAccountTemplate = template.Must(template.New("get_account").Parse(`
 
 		<button>Upload Identity Provider SAML Metadata</button>
 	</form>
+
+	<form action="{{ .ID }}/saml/config" method="post">
+		<input type="text" name="email_attribute" placeholder="email attribute name" />
+		<input type="text" name="display_name_attribute" placeholder="display name attribute name" />
+		<input type="text" name="groups_attribute" placeholder="groups attribute name" />
+		<input type="text" name="allowed_groups" placeholder="comma-separated allowed groups" />
+		<select name="provisioning_mode">
+			<option value="jit">Just-in-time provisioning</option>
+			<option value="jit_update">Just-in-time provisioning, with profile sync</option>
+			<option value="strict">No provisioning (users must already exist)</option>
+		</select>
+
+		<button>Save SAML Identity Mapping</button>
+	</form>
 `))
 
 var listUsersTemplate = template.Must(template.New("list_users").Parse(`
@@ -366,6 +586,10 @@ func main() {
 	}
 
 	store := store{DB: db}
+	samlVerifier := saml.Verifier{
+		Cache:     &saml.SQLAssertionIDCache{DB: db.DB},
+		ClockSkew: time.Minute,
+	}
 	router := httprouter.New()
 
 	router.GET("/", func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
@@ -545,16 +769,77 @@ func main() {
 
 		samlRedirectURL := redirectURL.String()
 
+		var samlSLOURL *string
+		if sloURL, err := metadata.IDPSSODescriptor.SLOEndpoint(saml.SingleSignOnServiceBindingHTTPRedirect); err == nil {
+			s := sloURL.String()
+			samlSLOURL = &s
+		} else if err != saml.ErrNoSLOEndpoint {
+			fmt.Fprintf(w, err.Error())
+			return
+		}
+
 		store.updateAccount(r.Context(), account{
 			ID:              accountUUID,
 			SAMLIssuer:      &entityID,
 			SAMLX509:        cert.Raw,
 			SAMLRedirectURL: &samlRedirectURL,
+			SAMLSLOURL:      samlSLOURL,
 		})
 
 		http.Redirect(w, r, fmt.Sprintf("/accounts/%s", accountID), http.StatusFound)
 	})
 
+	router.POST("/accounts/:account_id/saml/config", func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		// Lets an admin configure how IdP attributes map onto a user's
+		// identity, and how users are provisioned on first SAML login.
+		accountID := p.ByName("account_id")
+		if _, err := authorize(&store, w, r, accountID); err != nil {
+			fmt.Fprintf(w, err.Error())
+			return
+		}
+
+		accountUUID, err := uuid.Parse(accountID)
+		if err != nil {
+			fmt.Fprintf(w, err.Error())
+			return
+		}
+
+		if err := r.ParseForm(); err != nil {
+			fmt.Fprintf(w, err.Error())
+			return
+		}
+
+		var emailAttr, displayNameAttr, groupsAttr *string
+		if v := r.FormValue("email_attribute"); v != "" {
+			emailAttr = &v
+		}
+
+		if v := r.FormValue("display_name_attribute"); v != "" {
+			displayNameAttr = &v
+		}
+
+		if v := r.FormValue("groups_attribute"); v != "" {
+			groupsAttr = &v
+		}
+
+		var allowedGroups []string
+		if v := r.FormValue("allowed_groups"); v != "" {
+			allowedGroups = strings.Split(v, ",")
+		}
+
+		provisioningMode := r.FormValue("provisioning_mode")
+		if provisioningMode == "" {
+			provisioningMode = ProvisioningModeJIT
+		}
+
+		if err := store.updateAccountSAMLConfig(r.Context(), accountUUID, emailAttr, displayNameAttr, groupsAttr, provisioningMode, allowedGroups); err != nil {
+			fmt.Fprintf(w, err.Error())
+			return
+		}
+
+		http.Redirect(w, r, fmt.Sprintf("/accounts/%s", accountID), http.StatusFound)
+	})
+
 	router.GET("/accounts/:account_id/saml/initiate", func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
 		// This endpoint is intentionally not checking for authentication /
 		// authorization. Think of this endpoint as a customizable login page, where
@@ -574,7 +859,48 @@ func main() {
 			return
 		}
 
-		http.Redirect(w, r, *account.SAMLRedirectURL, http.StatusFound)
+		idpSSO, err := url.Parse(*account.SAMLRedirectURL)
+		if err != nil {
+			fmt.Fprintf(w, err.Error())
+			return
+		}
+
+		issuer := fmt.Sprintf("http://localhost:8080/accounts/%s/saml", accountID)
+		acsURL := fmt.Sprintf("http://localhost:8080/accounts/%s/saml/acs", accountID)
+
+		authnRequest, err := saml.NewAuthnRequest(issuer, acsURL, idpSSO.String())
+		if err != nil {
+			fmt.Fprintf(w, err.Error())
+			return
+		}
+
+		relayState, err := saml.NewRequestID()
+		if err != nil {
+			fmt.Fprintf(w, err.Error())
+			return
+		}
+
+		redirectURL, requestID, err := saml.BuildRedirectURL(idpSSO, authnRequest, relayState)
+		if err != nil {
+			fmt.Fprintf(w, err.Error())
+			return
+		}
+
+		http.SetCookie(w, &http.Cookie{
+			Name:     "saml_relay_state",
+			Path:     fmt.Sprintf("/accounts/%s/saml/acs", accountID),
+			Expires:  time.Now().Add(5 * time.Minute),
+			HttpOnly: true,
+			// The IdP delivers SAMLResponse/RelayState back to /saml/acs as a
+			// cross-site, top-level POST from its auto-submitting form, so this
+			// cookie needs SameSite=None (and Secure, once this isn't just
+			// localhost) to actually arrive: SameSite=Lax, the browser default,
+			// is not sent on cross-site POSTs.
+			SameSite: http.SameSiteNoneMode,
+			Value:    signRelayState(relayState + "|" + requestID),
+		})
+
+		http.Redirect(w, r, redirectURL.String(), http.StatusFound)
 	})
 
 	router.POST("/accounts/:account_id/saml/acs", func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
@@ -602,40 +928,154 @@ func main() {
 
 		expectedDestinationID := fmt.Sprintf("http://localhost:8080/accounts/%s/saml", accountID)
 		rawSAMLResponse := r.FormValue(saml.ParamSAMLResponse)
-		samlResponse, err := saml.Verify(rawSAMLResponse, *account.SAMLIssuer, cert, expectedDestinationID, time.Now())
+
+		// If we have a saml_relay_state cookie, this is an SP-initiated login:
+		// require the echoed RelayState to match it, and the response to be in
+		// reply to the AuthnRequest it stashed. Otherwise, this is an
+		// IdP-initiated login, which carries no RelayState or InResponseTo to
+		// check.
+		opts := saml.VerifyOptions{AllowIdPInitiated: true}
+		if cookie, err := r.Cookie("saml_relay_state"); err == nil {
+			http.SetCookie(w, &http.Cookie{
+				Name:    "saml_relay_state",
+				Path:    r.URL.Path,
+				Expires: time.Unix(0, 0),
+				Value:   "",
+			})
+
+			stashed, ok := verifyRelayState(cookie.Value)
+			if !ok {
+				fmt.Fprintf(w, "invalid saml_relay_state cookie")
+				return
+			}
+
+			i := strings.Index(stashed, "|")
+			if i < 0 {
+				fmt.Fprintf(w, "invalid saml_relay_state cookie")
+				return
+			}
+
+			relayState, requestID := stashed[:i], stashed[i+1:]
+			if relayState != r.FormValue(saml.ParamRelayState) {
+				fmt.Fprintf(w, "RelayState did not match saml_relay_state cookie")
+				return
+			}
+
+			opts = saml.VerifyOptions{ExpectedRequestID: requestID}
+		}
+
+		if account.SAMLSPPrivateKey != nil {
+			key, err := parseSPPrivateKey(account.SAMLSPPrivateKey)
+			if err != nil {
+				fmt.Fprintf(w, err.Error())
+				return
+			}
+
+			opts.DecryptionKey = key
+		}
+
+		samlResponse, err := samlVerifier.Verify(r.Context(), rawSAMLResponse, *account.SAMLIssuer, []*x509.Certificate{cert}, expectedDestinationID, time.Now(), opts)
 		if err != nil {
 			fmt.Fprintf(w, err.Error())
 			return
 		}
 
+		// Resolve this login's identity using the account's configured
+		// attribute mapping, falling back to NameID when no mapping is set.
 		samlUserID := samlResponse.Assertion.Subject.NameID.Value
-		existingUser, err := store.getUserBySAMLID(r.Context(), accountUUID, samlUserID)
 
-		var loginUser user
-		if err == nil {
-			loginUser = existingUser
-		} else if err == sql.ErrNoRows {
+		email := samlUserID
+		if account.SAMLEmailAttribute != nil {
+			if values := samlResponse.Assertion.Attribute(*account.SAMLEmailAttribute); len(values) > 0 {
+				email = values[0]
+			}
+		}
+
+		displayName := samlUserID
+		if account.SAMLDisplayNameAttribute != nil {
+			if values := samlResponse.Assertion.Attribute(*account.SAMLDisplayNameAttribute); len(values) > 0 {
+				displayName = values[0]
+			}
+		}
+
+		var groups []string
+		if account.SAMLGroupsAttribute != nil {
+			groups = samlResponse.Assertion.Attribute(*account.SAMLGroupsAttribute)
+		}
+
+		if len(account.SAMLAllowedGroups) > 0 {
+			allowed := false
+			for _, g := range groups {
+				for _, a := range account.SAMLAllowedGroups {
+					if g == a {
+						allowed = true
+					}
+				}
+			}
+
+			if !allowed {
+				fmt.Fprintf(w, "user's SAML groups are not in this account's allowed_groups")
+				return
+			}
+		}
+
+		provisioningMode := account.SAMLProvisioningMode
+		if provisioningMode == "" {
+			provisioningMode = ProvisioningModeJIT
+		}
+
+		// Resolve by SAMLID first, then fall back to email, so a user
+		// originally created with a password can be upgraded to SAML on
+		// their first SAML login rather than getting a duplicate account.
+		loginUser, err := store.getUserBySAMLID(r.Context(), accountUUID, samlUserID)
+		if err == sql.ErrNoRows {
+			loginUser, err = store.getUserByEmail(r.Context(), accountUUID, email)
+		}
+
+		switch {
+		case err == nil:
+			if loginUser.SAMLID == nil || provisioningMode == ProvisioningModeJITUpdate {
+				if err := store.updateUserSAMLProfile(r.Context(), loginUser.ID, samlUserID, displayName, groups); err != nil {
+					fmt.Fprintf(w, err.Error())
+					return
+				}
+
+				loginUser.SAMLID = &samlUserID
+				loginUser.DisplayName = displayName
+				loginUser.Groups = groups
+			}
+		case err == sql.ErrNoRows:
+			if provisioningMode == ProvisioningModeStrict {
+				fmt.Fprintf(w, "no existing user matches this SAML login, and this account does not allow just-in-time provisioning")
+				return
+			}
+
 			provisionedUser := user{
 				AccountID:   accountUUID,
 				ID:          uuid.New(),
 				SAMLID:      &samlUserID,
-				DisplayName: samlUserID,
+				Email:       &email,
+				DisplayName: displayName,
+				Groups:      groups,
 			}
 
-			err := store.createUser(r.Context(), provisionedUser)
-
-			if err != nil {
+			if err := store.createUser(r.Context(), provisionedUser); err != nil {
 				fmt.Fprintf(w, err.Error())
 				return
 			}
 
 			loginUser = provisionedUser
-		} else {
+		default:
 			fmt.Fprintf(w, err.Error())
 			return
 		}
 
-		s := session{ID: uuid.New(), UserID: loginUser.ID, ExpiresAt: time.Now().Add(time.Hour * 24)}
+		var samlSessionIndex *string
+		if idx := samlResponse.Assertion.AuthnStatement.SessionIndex; idx != "" {
+			samlSessionIndex = &idx
+		}
+
+		s := session{ID: uuid.New(), UserID: loginUser.ID, ExpiresAt: time.Now().Add(time.Hour * 24), SAMLSessionIndex: samlSessionIndex}
 		if err := store.createSession(r.Context(), s); err != nil {
 			fmt.Fprintf(w, err.Error())
 			return
@@ -651,6 +1091,266 @@ func main() {
 		http.Redirect(w, r, fmt.Sprintf("/accounts/%s/todos", accountID), http.StatusFound)
 	})
 
+	router.GET("/accounts/:account_id/saml/metadata", func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		// Lets an admin download this account's SP metadata, to upload into
+		// their IdP instead of copy-pasting the ACS URL and entity ID by hand.
+		accountID := p.ByName("account_id")
+		if _, err := authorize(&store, w, r, accountID); err != nil {
+			fmt.Fprintf(w, err.Error())
+			return
+		}
+
+		accountUUID, err := uuid.Parse(accountID)
+		if err != nil {
+			fmt.Fprintf(w, err.Error())
+			return
+		}
+
+		account, err := store.getAccount(r.Context(), accountUUID)
+		if err != nil {
+			fmt.Fprintf(w, err.Error())
+			return
+		}
+
+		issuer := fmt.Sprintf("http://localhost:8080/accounts/%s/saml", accountID)
+		acsURL := fmt.Sprintf("http://localhost:8080/accounts/%s/saml/acs", accountID)
+
+		var encryptionCert *x509.Certificate
+		if account.SAMLSPPrivateKey != nil {
+			key, err := parseSPPrivateKey(account.SAMLSPPrivateKey)
+			if err != nil {
+				fmt.Fprintf(w, err.Error())
+				return
+			}
+
+			encryptionCert, err = selfSignedSPCert(key, issuer)
+			if err != nil {
+				fmt.Fprintf(w, err.Error())
+				return
+			}
+		}
+
+		metadata, err := saml.BuildSPMetadata(issuer, acsURL, nil, encryptionCert, false)
+		if err != nil {
+			fmt.Fprintf(w, err.Error())
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/xml")
+		w.Header().Set("Content-Disposition", `attachment; filename="sp-metadata.xml"`)
+		w.Write(metadata)
+	})
+
+	router.POST("/accounts/:account_id/saml/sp-key/generate", func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		// Generates a fresh SP keypair for this account, so it can both
+		// decrypt EncryptedAssertion responses and advertise its public key
+		// in the SP metadata served above.
+		accountID := p.ByName("account_id")
+		if _, err := authorize(&store, w, r, accountID); err != nil {
+			fmt.Fprintf(w, err.Error())
+			return
+		}
+
+		accountUUID, err := uuid.Parse(accountID)
+		if err != nil {
+			fmt.Fprintf(w, err.Error())
+			return
+		}
+
+		key, err := generateSPKeypair()
+		if err != nil {
+			fmt.Fprintf(w, err.Error())
+			return
+		}
+
+		if err := store.updateAccountSPPrivateKey(r.Context(), accountUUID, key); err != nil {
+			fmt.Fprintf(w, err.Error())
+			return
+		}
+
+		http.Redirect(w, r, fmt.Sprintf("/accounts/%s", accountID), http.StatusFound)
+	})
+
+	router.GET("/accounts/:account_id/saml/slo/initiate", func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		// Starts an SP-initiated logout: tears down the local session, then
+		// sends the browser to the IdP's SingleLogoutService so it can tear
+		// down its own session (and any other SP's sessions it started).
+		accountID := p.ByName("account_id")
+		loginUser, err := authorize(&store, w, r, accountID)
+		if err != nil {
+			fmt.Fprintf(w, err.Error())
+			return
+		}
+
+		accountUUID, err := uuid.Parse(accountID)
+		if err != nil {
+			fmt.Fprintf(w, err.Error())
+			return
+		}
+
+		account, err := store.getAccount(r.Context(), accountUUID)
+		if err != nil {
+			fmt.Fprintf(w, err.Error())
+			return
+		}
+
+		if account.SAMLSLOURL == nil {
+			fmt.Fprintf(w, "account has no SAML SLO URL configured")
+			return
+		}
+
+		idpSLO, err := url.Parse(*account.SAMLSLOURL)
+		if err != nil {
+			fmt.Fprintf(w, err.Error())
+			return
+		}
+
+		sessionCookie, err := r.Cookie("session_token")
+		if err != nil {
+			fmt.Fprintf(w, err.Error())
+			return
+		}
+
+		sessionID, err := uuid.Parse(sessionCookie.Value)
+		if err != nil {
+			fmt.Fprintf(w, err.Error())
+			return
+		}
+
+		sess, err := store.getSession(r.Context(), sessionID)
+		if err != nil {
+			fmt.Fprintf(w, err.Error())
+			return
+		}
+
+		if err := store.deleteSession(r.Context(), sessionID); err != nil {
+			fmt.Fprintf(w, err.Error())
+			return
+		}
+
+		var sessionIndex string
+		if sess.SAMLSessionIndex != nil {
+			sessionIndex = *sess.SAMLSessionIndex
+		}
+
+		var nameID string
+		if loginUser.SAMLID != nil {
+			nameID = *loginUser.SAMLID
+		}
+
+		issuer := fmt.Sprintf("http://localhost:8080/accounts/%s/saml", accountID)
+
+		logoutRequest, err := saml.NewLogoutRequest(issuer, idpSLO.String(), nameID, sessionIndex)
+		if err != nil {
+			fmt.Fprintf(w, err.Error())
+			return
+		}
+
+		redirectURL, requestID, err := saml.BuildLogoutRedirectURL(idpSLO, logoutRequest, "")
+		if err != nil {
+			fmt.Fprintf(w, err.Error())
+			return
+		}
+
+		http.SetCookie(w, &http.Cookie{
+			Name:    "session_token",
+			Path:    "/",
+			Expires: time.Unix(0, 0),
+			Value:   "",
+		})
+
+		http.SetCookie(w, &http.Cookie{
+			Name:     "saml_slo_relay_state",
+			Path:     fmt.Sprintf("/accounts/%s/saml/slo", accountID),
+			Expires:  time.Now().Add(5 * time.Minute),
+			HttpOnly: true,
+			// Same reasoning as the saml_relay_state cookie in /saml/initiate:
+			// the IdP delivers its LogoutResponse back as a cross-site,
+			// top-level POST/redirect, so this needs SameSite=None to arrive.
+			SameSite: http.SameSiteNoneMode,
+			Value:    signRelayState(requestID),
+		})
+
+		http.Redirect(w, r, redirectURL.String(), http.StatusFound)
+	})
+
+	router.GET("/accounts/:account_id/saml/slo", func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		// Handles an IdP-initiated LogoutRequest: the IdP is telling us a
+		// user's session elsewhere has ended, so we tear down every local
+		// session tied to the same SAML SessionIndex.
+		accountID := p.ByName("account_id")
+
+		accountUUID, err := uuid.Parse(accountID)
+		if err != nil {
+			fmt.Fprintf(w, err.Error())
+			return
+		}
+
+		account, err := store.getAccount(r.Context(), accountUUID)
+		if err != nil {
+			fmt.Fprintf(w, err.Error())
+			return
+		}
+
+		cert, err := x509.ParseCertificate(account.SAMLX509)
+		if err != nil {
+			fmt.Fprintf(w, err.Error())
+			return
+		}
+
+		destination := fmt.Sprintf("http://localhost:8080/accounts/%s/saml/slo", accountID)
+
+		switch {
+		case r.FormValue(saml.ParamSAMLRequest) != "":
+			logoutRequest, err := saml.VerifyLogoutRequest(r.FormValue(saml.ParamSAMLRequest), *account.SAMLIssuer, cert, destination, time.Now())
+			if err != nil {
+				fmt.Fprintf(w, err.Error())
+				return
+			}
+
+			if err := store.deleteSessionsBySAMLSessionIndex(r.Context(), accountUUID, logoutRequest.SessionIndex); err != nil {
+				fmt.Fprintf(w, err.Error())
+				return
+			}
+		case r.FormValue(saml.ParamSAMLResponse) != "":
+			// This is the IdP's reply to the SP-initiated logout we started
+			// in /saml/slo/initiate: verify it's actually in response to that
+			// request, and that the IdP reports the logout succeeded, before
+			// treating the user as logged out.
+			cookie, err := r.Cookie("saml_slo_relay_state")
+			if err != nil {
+				fmt.Fprintf(w, err.Error())
+				return
+			}
+
+			requestID, ok := verifyRelayState(cookie.Value)
+			if !ok {
+				fmt.Fprintf(w, "invalid saml_slo_relay_state cookie")
+				return
+			}
+
+			http.SetCookie(w, &http.Cookie{
+				Name:    "saml_slo_relay_state",
+				Path:    r.URL.Path,
+				Expires: time.Unix(0, 0),
+				Value:   "",
+			})
+
+			logoutResponse, err := saml.VerifyLogoutResponse(r.FormValue(saml.ParamSAMLResponse), *account.SAMLIssuer, cert, destination, requestID, time.Now())
+			if err != nil {
+				fmt.Fprintf(w, err.Error())
+				return
+			}
+
+			if logoutResponse.Status.StatusCode.Value != saml.StatusCodeSuccess {
+				fmt.Fprintf(w, "IdP reported logout did not succeed: %s", logoutResponse.Status.StatusCode.Value)
+				return
+			}
+		}
+
+		fmt.Fprintf(w, "logged out")
+	})
+
 	router.GET("/accounts/:account_id/users", func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
 		accountID := p.ByName("account_id")
 		if _, err := authorize(&store, w, r, accountID); err != nil {
@@ -0,0 +1,213 @@
+package saml
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/xml"
+	"errors"
+	"net/url"
+	"time"
+
+	"github.com/ucarion/dsig"
+)
+
+// ErrLogoutRequestNotSigned indicates that a LogoutRequest was not signed.
+var ErrLogoutRequestNotSigned = errors.New("saml: logout request not signed")
+
+// ErrLogoutResponseNotSigned indicates that a LogoutResponse was not signed.
+var ErrLogoutResponseNotSigned = errors.New("saml: logout response not signed")
+
+// ErrLogoutMessageExpired indicates that a LogoutRequest or LogoutResponse's
+// IssueInstant was more than maxLogoutMessageAge away from the time it was
+// verified at, in either direction.
+var ErrLogoutMessageExpired = errors.New("saml: logout message expired")
+
+// maxLogoutMessageAge bounds how far a LogoutRequest or LogoutResponse's
+// IssueInstant may differ from now, in either direction, for
+// VerifyLogoutRequest or VerifyLogoutResponse to accept it.
+//
+// Unlike an Assertion, a SAML logout message doesn't carry its own
+// expiration (there's no NotOnOrAfter to check), so without a bound here a
+// captured, validly-signed LogoutRequest or LogoutResponse could be replayed
+// indefinitely.
+const maxLogoutMessageAge = 5 * time.Minute
+
+// checkLogoutIssueInstant rejects an IssueInstant more than
+// maxLogoutMessageAge away from now, in either direction.
+func checkLogoutIssueInstant(issueInstant, now time.Time) error {
+	if issueInstant.Before(now.Add(-maxLogoutMessageAge)) || issueInstant.After(now.Add(maxLogoutMessageAge)) {
+		return ErrLogoutMessageExpired
+	}
+
+	return nil
+}
+
+// LogoutRequest represents a SAML <samlp:LogoutRequest>, sent by one party
+// to another to ask that a user's session be torn down everywhere: by an IdP
+// to start an IdP-initiated logout, or by an SP (built with
+// NewLogoutRequest) to start an SP-initiated one.
+type LogoutRequest struct {
+	XMLName      xml.Name       `xml:"urn:oasis:names:tc:SAML:2.0:protocol LogoutRequest"`
+	ID           string         `xml:"ID,attr"`
+	Version      string         `xml:"Version,attr"`
+	IssueInstant time.Time      `xml:"IssueInstant,attr"`
+	Destination  string         `xml:"Destination,attr,omitempty"`
+	Signature    dsig.Signature `xml:"Signature"`
+	Issuer       Issuer         `xml:"Issuer"`
+	NameID       NameID         `xml:"NameID"`
+	SessionIndex string         `xml:"SessionIndex,omitempty"`
+}
+
+// NewLogoutRequest builds an SP-initiated LogoutRequest with a fresh, random
+// ID (suitable for later use as the expectedRequestID passed to
+// VerifyLogoutResponse), and IssueInstant set to now.
+//
+// issuer is this service provider's entity ID. destination is the IdP's
+// SingleLogoutService endpoint. nameID and sessionIndex identify the session
+// being logged out, and are usually the NameID and SessionIndex the IdP
+// originally asserted at login.
+func NewLogoutRequest(issuer, destination, nameID, sessionIndex string) (LogoutRequest, error) {
+	id, err := NewRequestID()
+	if err != nil {
+		return LogoutRequest{}, err
+	}
+
+	return LogoutRequest{
+		ID:           id,
+		Version:      "2.0",
+		IssueInstant: time.Now().UTC(),
+		Destination:  destination,
+		Issuer:       Issuer{Name: issuer},
+		NameID:       NameID{Value: nameID},
+		SessionIndex: sessionIndex,
+	}, nil
+}
+
+// BuildLogoutRedirectURL encodes req for delivery to idpSLO via the SAML 2.0
+// HTTP-Redirect binding, the same way BuildRedirectURL encodes an
+// AuthnRequest.
+//
+// It returns the URL the user's browser should be redirected to, and req's
+// ID, which the caller should stash and later pass as the expectedRequestID
+// argument to VerifyLogoutResponse.
+func BuildLogoutRedirectURL(idpSLO *url.URL, req LogoutRequest, relayState string) (*url.URL, string, error) {
+	result, err := buildRedirectBindingURL(idpSLO, ParamSAMLRequest, req, relayState, nil)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return result, req.ID, nil
+}
+
+// VerifyLogoutRequest parses and verifies a LogoutRequest delivered over the
+// HTTP-Redirect binding, as in an IdP-initiated logout.
+//
+// raw is the SAMLRequest query parameter. issuer is the expected issuer of
+// the request; cert is the certificate it's expected to be signed with, as
+// in Verify. destination, if non-empty, is the expected Destination, usually
+// this SP's SLO endpoint. now is compared against IssueInstant, which must
+// be within maxLogoutMessageAge of it; SAML logout requests don't carry
+// their own expiration.
+func VerifyLogoutRequest(raw, issuer string, cert *x509.Certificate, destination string, now time.Time) (*LogoutRequest, error) {
+	var req LogoutRequest
+	data, err := decodeRedirectBindingMessage(raw, &req)
+	if err != nil {
+		return nil, err
+	}
+
+	if req.Signature.SignatureValue == "" {
+		return nil, ErrLogoutRequestNotSigned
+	}
+
+	if err := req.Signature.Verify(cert, xml.NewDecoder(bytes.NewReader(data))); err != nil {
+		return nil, err
+	}
+
+	if req.Issuer.Name != issuer {
+		return nil, ErrInvalidIssuer
+	}
+
+	if destination != "" && req.Destination != "" && req.Destination != destination {
+		return nil, ErrInvalidDestination
+	}
+
+	if err := checkLogoutIssueInstant(req.IssueInstant, now); err != nil {
+		return nil, err
+	}
+
+	return &req, nil
+}
+
+// LogoutResponse represents a SAML <samlp:LogoutResponse>, sent in reply to
+// a LogoutRequest.
+type LogoutResponse struct {
+	XMLName      xml.Name       `xml:"urn:oasis:names:tc:SAML:2.0:protocol LogoutResponse"`
+	ID           string         `xml:"ID,attr"`
+	Version      string         `xml:"Version,attr"`
+	IssueInstant time.Time      `xml:"IssueInstant,attr"`
+	Destination  string         `xml:"Destination,attr,omitempty"`
+	InResponseTo string         `xml:"InResponseTo,attr"`
+	Signature    dsig.Signature `xml:"Signature"`
+	Issuer       Issuer         `xml:"Issuer"`
+	Status       Status         `xml:"Status"`
+}
+
+// Status indicates whether a SAML protocol message was processed
+// successfully.
+type Status struct {
+	XMLName    xml.Name   `xml:"urn:oasis:names:tc:SAML:2.0:protocol Status"`
+	StatusCode StatusCode `xml:"StatusCode"`
+}
+
+// StatusCode holds the top-level status code of a Status.
+type StatusCode struct {
+	Value string `xml:"Value,attr"`
+}
+
+// StatusCodeSuccess is the URI Status.StatusCode.Value takes when a request
+// was processed successfully.
+const StatusCodeSuccess = "urn:oasis:names:tc:SAML:2.0:status:Success"
+
+// VerifyLogoutResponse parses and verifies a LogoutResponse delivered over
+// the HTTP-Redirect binding, correlating it to the SP-initiated
+// LogoutRequest it's in reply to.
+//
+// raw is the SAMLResponse query parameter. issuer, cert, destination, and
+// now are as in VerifyLogoutRequest, including the IssueInstant freshness
+// check. expectedRequestID is the ID of the LogoutRequest this response is
+// expected to be in reply to, as returned by BuildLogoutRedirectURL; if the
+// response's InResponseTo doesn't match, VerifyLogoutResponse returns
+// ErrInvalidInResponseTo.
+func VerifyLogoutResponse(raw, issuer string, cert *x509.Certificate, destination, expectedRequestID string, now time.Time) (*LogoutResponse, error) {
+	var resp LogoutResponse
+	data, err := decodeRedirectBindingMessage(raw, &resp)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.Signature.SignatureValue == "" {
+		return nil, ErrLogoutResponseNotSigned
+	}
+
+	if err := resp.Signature.Verify(cert, xml.NewDecoder(bytes.NewReader(data))); err != nil {
+		return nil, err
+	}
+
+	if resp.Issuer.Name != issuer {
+		return nil, ErrInvalidIssuer
+	}
+
+	if destination != "" && resp.Destination != "" && resp.Destination != destination {
+		return nil, ErrInvalidDestination
+	}
+
+	if resp.InResponseTo != expectedRequestID {
+		return nil, ErrInvalidInResponseTo
+	}
+
+	if err := checkLogoutIssueInstant(resp.IssueInstant, now); err != nil {
+		return nil, err
+	}
+
+	return &resp, nil
+}
@@ -0,0 +1,221 @@
+package saml
+
+import (
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"net/url"
+)
+
+// SingleSignOnServiceBindingHTTPRedirect is the URI for a SAML HTTP-Redirect
+// Binding.
+const SingleSignOnServiceBindingHTTPRedirect = "urn:oasis:names:tc:SAML:2.0:bindings:HTTP-Redirect"
+
+// SingleSignOnServiceBindingHTTPPOST is the URI for a SAML HTTP-POST Binding.
+const SingleSignOnServiceBindingHTTPPOST = "urn:oasis:names:tc:SAML:2.0:bindings:HTTP-POST"
+
+// KeyDescriptorUseSigning and KeyDescriptorUseEncryption are the values a
+// KeyDescriptor's Use attribute takes to declare what its certificate is
+// used for. A KeyDescriptor with no Use at all is valid for both.
+const (
+	KeyDescriptorUseSigning    = "signing"
+	KeyDescriptorUseEncryption = "encryption"
+)
+
+// ErrNoRedirectBinding indicates that an EntityDescriptor did not declare an
+// HTTP-Redirect binding.
+var ErrNoRedirectBinding = errors.New("saml: no HTTP redirect binding in IdP metadata")
+
+// ErrNoSSOEndpoint indicates that an EntityDescriptor did not declare a
+// SingleSignOnService for the requested binding.
+var ErrNoSSOEndpoint = errors.New("saml: no SingleSignOnService for the given binding in IdP metadata")
+
+// ErrNoSigningCertificate indicates that an EntityDescriptor did not declare
+// any certificate usable to verify signatures.
+var ErrNoSigningCertificate = errors.New("saml: no signing certificate in IdP metadata")
+
+// ErrNoEncryptionCertificate indicates that an EntityDescriptor did not
+// declare a certificate usable to encrypt data (e.g. assertions) for the
+// entity.
+var ErrNoEncryptionCertificate = errors.New("saml: no encryption certificate in IdP metadata")
+
+// EntityDescriptor describes a SAML entity. This is often referred to as
+// "metadata".
+//
+// This struct is meant to store "Identity Provider metadata"; it's meant to
+// store the description of a SAML Identity Provider.
+type EntityDescriptor struct {
+	XMLName          xml.Name         `xml:"urn:oasis:names:tc:SAML:2.0:metadata EntityDescriptor"`
+	EntityID         string           `xml:"entityID,attr"`
+	IDPSSODescriptor IDPSSODescriptor `xml:"IDPSSODescriptor"`
+}
+
+// GetEntityIDCertificateAndRedirectURL extracts an issuer entity ID, a x509
+// certificate, and a redirect URL from a set of Identity Provider metadata.
+//
+// It uses the first signing certificate declared in the metadata; IdPs that
+// roll over their signing key typically list the new certificate first,
+// alongside the old one, until the rollover is complete. Callers that want
+// to accept either certificate during a rollover should use
+// IDPSSODescriptor.SigningCertificates directly, together with
+// VerifyWithCerts.
+//
+// Returns an error if the redirect URL is malformed. Malformed certificates
+// are skipped, as in SigningCertificates; if no parseable signing
+// certificate remains, returns ErrNoSigningCertificate.
+// If there is no redirect URL at all, returns ErrNoRedirectBinding.
+func (d *EntityDescriptor) GetEntityIDCertificateAndRedirectURL() (string, *x509.Certificate, *url.URL, error) {
+	certs := d.IDPSSODescriptor.SigningCertificates()
+	if len(certs) == 0 {
+		return "", nil, nil, ErrNoSigningCertificate
+	}
+
+	location, err := d.IDPSSODescriptor.SSOEndpoint(SingleSignOnServiceBindingHTTPRedirect)
+	if err == ErrNoSSOEndpoint {
+		return "", nil, nil, ErrNoRedirectBinding
+	} else if err != nil {
+		return "", nil, nil, err
+	}
+
+	return d.EntityID, certs[0], location, nil
+}
+
+// IDPSSODescriptor describes the single-sign-on offerings of an identity
+// provider.
+type IDPSSODescriptor struct {
+	XMLName              xml.Name              `xml:"urn:oasis:names:tc:SAML:2.0:metadata IDPSSODescriptor"`
+	KeyDescriptors       []KeyDescriptor       `xml:"KeyDescriptor"`
+	SingleSignOnServices []SingleSignOnService `xml:"SingleSignOnService"`
+	SingleLogoutServices []SingleLogoutService `xml:"SingleLogoutService"`
+}
+
+// SigningCertificates returns the x509 certificates this IdP declares it
+// signs responses and assertions with, in document order. During a key
+// rollover, IdP metadata typically lists more than one: callers should
+// accept a signature from any of them, e.g. via VerifyWithCerts.
+//
+// A KeyDescriptor with no Use attribute at all is treated as usable for
+// signing, per the SAML metadata spec. KeyDescriptors whose certificate
+// can't be parsed are silently skipped.
+func (d *IDPSSODescriptor) SigningCertificates() []*x509.Certificate {
+	var certs []*x509.Certificate
+	for _, kd := range d.KeyDescriptors {
+		if kd.Use != "" && kd.Use != KeyDescriptorUseSigning {
+			continue
+		}
+
+		if cert, err := kd.certificate(); err == nil {
+			certs = append(certs, cert)
+		}
+	}
+
+	return certs
+}
+
+// EncryptionCertificate returns the x509 certificate this IdP declares
+// should be used to encrypt data (e.g. an EncryptedAssertion) sent to it. A
+// KeyDescriptor with use="encryption" is preferred; failing that, the first
+// one with no Use attribute is used. If there is no such certificate,
+// returns ErrNoEncryptionCertificate.
+func (d *IDPSSODescriptor) EncryptionCertificate() (*x509.Certificate, error) {
+	var fallback *KeyDescriptor
+	for i, kd := range d.KeyDescriptors {
+		if kd.Use == KeyDescriptorUseEncryption {
+			return kd.certificate()
+		}
+
+		if kd.Use == "" && fallback == nil {
+			fallback = &d.KeyDescriptors[i]
+		}
+	}
+
+	if fallback != nil {
+		return fallback.certificate()
+	}
+
+	return nil, ErrNoEncryptionCertificate
+}
+
+// SSOEndpoint returns the URL of this IdP's SingleSignOnService for the
+// given binding (one of SingleSignOnServiceBindingHTTPRedirect or
+// SingleSignOnServiceBindingHTTPPOST). If there is no such endpoint, returns
+// ErrNoSSOEndpoint.
+func (d *IDPSSODescriptor) SSOEndpoint(binding string) (*url.URL, error) {
+	for _, s := range d.SingleSignOnServices {
+		if s.Binding == binding {
+			return url.Parse(s.Location)
+		}
+	}
+
+	return nil, ErrNoSSOEndpoint
+}
+
+// ErrNoSLOEndpoint indicates that an EntityDescriptor did not declare a
+// SingleLogoutService for the requested binding.
+var ErrNoSLOEndpoint = errors.New("saml: no SingleLogoutService for the given binding in IdP metadata")
+
+// SLOEndpoint returns the URL of this IdP's SingleLogoutService for the
+// given binding (one of SingleSignOnServiceBindingHTTPRedirect or
+// SingleSignOnServiceBindingHTTPPOST). If there is no such endpoint, returns
+// ErrNoSLOEndpoint.
+func (d *IDPSSODescriptor) SLOEndpoint(binding string) (*url.URL, error) {
+	for _, s := range d.SingleLogoutServices {
+		if s.Binding == binding {
+			return url.Parse(s.Location)
+		}
+	}
+
+	return nil, ErrNoSLOEndpoint
+}
+
+// SingleLogoutService describes a single binding of an identity provider's
+// Single Logout endpoint, and the URL where it can be reached.
+type SingleLogoutService struct {
+	XMLName  xml.Name `xml:"urn:oasis:names:tc:SAML:2.0:metadata SingleLogoutService"`
+	Binding  string   `xml:"Binding,attr"`
+	Location string   `xml:"Location,attr"`
+}
+
+// KeyDescriptor describes a key an identity provider uses, either to sign
+// data it sends, or to have data encrypted to it.
+type KeyDescriptor struct {
+	XMLName xml.Name `xml:"urn:oasis:names:tc:SAML:2.0:metadata KeyDescriptor"`
+	Use     string   `xml:"use,attr"`
+	KeyInfo KeyInfo  `xml:"KeyInfo"`
+}
+
+func (kd KeyDescriptor) certificate() (*x509.Certificate, error) {
+	asn1Data, err := base64.StdEncoding.DecodeString(kd.KeyInfo.X509Data.X509Certificate.Value)
+	if err != nil {
+		return nil, err
+	}
+
+	return x509.ParseCertificate(asn1Data)
+}
+
+// KeyInfo is a XML-DSig description of a x509 key.
+type KeyInfo struct {
+	XMLName  xml.Name `xml:"http://www.w3.org/2000/09/xmldsig# KeyInfo"`
+	X509Data X509Data `xml:"X509Data"`
+}
+
+// X509Data contains an x509 certificate.
+type X509Data struct {
+	XMLName         xml.Name        `xml:"http://www.w3.org/2000/09/xmldsig# X509Data"`
+	X509Certificate X509Certificate `xml:"X509Certificate"`
+}
+
+// X509Certificate contains the base64-encoded ASN.1 data of a x509 certificate.
+type X509Certificate struct {
+	XMLName xml.Name `xml:"http://www.w3.org/2000/09/xmldsig# X509Certificate"`
+	Value   string   `xml:",chardata"`
+}
+
+// SingleSignOnService describes a single binding of an identity provider, and
+// the URL where it can be reached.
+type SingleSignOnService struct {
+	XMLName  xml.Name `xml:"urn:oasis:names:tc:SAML:2.0:metadata SingleSignOnService"`
+	Binding  string   `xml:"Binding,attr"`
+	Location string   `xml:"Location,attr"`
+}
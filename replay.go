@@ -0,0 +1,169 @@
+package saml
+
+import (
+	"context"
+	"crypto/x509"
+	"database/sql"
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrAssertionReplayed indicates that a Verifier's AssertionIDCache had
+// already recorded the assertion's ID, i.e. this exact assertion was
+// already used to log in once before.
+var ErrAssertionReplayed = errors.New("saml: assertion replayed")
+
+// ErrAssertionMissingID indicates that an assertion's ID attribute was
+// empty, so a Verifier can't safely use it to detect replay: caching an
+// empty ID would make every other assertion with an empty ID collide with
+// it in AssertionIDCache, regardless of which IdP issued them or whether
+// they're otherwise distinct.
+var ErrAssertionMissingID = errors.New("saml: assertion missing ID")
+
+// AssertionIDCache records the IDs of SAML assertions a Verifier has
+// accepted, so that a captured assertion can't be replayed before it
+// expires.
+//
+// SeenBefore should atomically check whether id has already been recorded,
+// and if not, record it. notOnOrAfter is the last moment the assertion is
+// still accepted (Verifier passes Assertion.Conditions.NotOnOrAfter plus its
+// ClockSkew): once it passes, the assertion would be rejected as expired
+// anyway, so an implementation is free to forget id at that point.
+type AssertionIDCache interface {
+	SeenBefore(ctx context.Context, id string, notOnOrAfter time.Time) (bool, error)
+}
+
+// Verifier is like VerifyWithCerts, but additionally rejects an assertion
+// whose ID Cache has already recorded, and tolerates up to ClockSkew of
+// difference between this server's clock and the IdP's when checking
+// NotBefore/NotOnOrAfter.
+type Verifier struct {
+	Cache     AssertionIDCache
+	ClockSkew time.Duration
+}
+
+// Verify parses and verifies a SAML response like VerifyWithCerts, with
+// opts.ClockSkew replaced by v.ClockSkew, then consults v.Cache to reject a
+// response whose assertion ID has already been accepted once before.
+func (v *Verifier) Verify(ctx context.Context, samlResponse, issuer string, certs []*x509.Certificate, recipient string, now time.Time, opts VerifyOptions) (Response, error) {
+	opts.ClockSkew = v.ClockSkew
+
+	response, err := VerifyWithCerts(samlResponse, issuer, certs, recipient, now, opts)
+	if err != nil {
+		return Response{}, err
+	}
+
+	if response.Assertion.ID == "" {
+		return Response{}, ErrAssertionMissingID
+	}
+
+	seen, err := v.Cache.SeenBefore(ctx, response.Assertion.ID, response.Assertion.Conditions.NotOnOrAfter.Add(v.ClockSkew))
+	if err != nil {
+		return Response{}, err
+	}
+
+	if seen {
+		return Response{}, ErrAssertionReplayed
+	}
+
+	return response, nil
+}
+
+// InMemoryAssertionIDCache is an AssertionIDCache backed by an in-process
+// map. It's suitable for a single-instance deployment; a deployment with
+// more than one instance should use SQLAssertionIDCache (or a similar cache
+// backed by storage shared across instances) instead, so a replay accepted
+// by one instance is still caught by the others.
+type InMemoryAssertionIDCache struct {
+	mu   sync.Mutex
+	seen map[string]time.Time
+	stop chan struct{}
+}
+
+// NewInMemoryAssertionIDCache creates an InMemoryAssertionIDCache, and
+// starts a background janitor goroutine that purges expired entries every
+// janitorInterval. Call Close to stop that goroutine.
+func NewInMemoryAssertionIDCache(janitorInterval time.Duration) *InMemoryAssertionIDCache {
+	c := &InMemoryAssertionIDCache{
+		seen: make(map[string]time.Time),
+		stop: make(chan struct{}),
+	}
+
+	go c.janitor(janitorInterval)
+	return c
+}
+
+func (c *InMemoryAssertionIDCache) janitor(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case now := <-ticker.C:
+			c.mu.Lock()
+			for id, expiresAt := range c.seen {
+				if now.After(expiresAt) {
+					delete(c.seen, id)
+				}
+			}
+			c.mu.Unlock()
+		case <-c.stop:
+			return
+		}
+	}
+}
+
+// Close stops the background janitor goroutine. It does not clear any
+// entries already recorded.
+func (c *InMemoryAssertionIDCache) Close() {
+	close(c.stop)
+}
+
+// SeenBefore implements AssertionIDCache.
+func (c *InMemoryAssertionIDCache) SeenBefore(ctx context.Context, id string, notOnOrAfter time.Time) (bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, ok := c.seen[id]; ok {
+		return true, nil
+	}
+
+	c.seen[id] = notOnOrAfter
+	return false, nil
+}
+
+// SQLAssertionIDCache is an AssertionIDCache backed by a SQL table, shared
+// across every instance of a service. It expects a table of the shape:
+//
+//	create table seen_saml_assertions (
+//		id text primary key,
+//		expires_at timestamptz not null
+//	)
+//
+// (column types as in Postgres; adjust for other databases as needed).
+// Callers are responsible for periodically deleting rows whose expires_at
+// has passed.
+type SQLAssertionIDCache struct {
+	DB *sql.DB
+}
+
+// SeenBefore implements AssertionIDCache with an INSERT ... ON CONFLICT DO
+// NOTHING: if the insert affects no rows, id was already present.
+func (c *SQLAssertionIDCache) SeenBefore(ctx context.Context, id string, notOnOrAfter time.Time) (bool, error) {
+	result, err := c.DB.ExecContext(ctx, `
+		insert into seen_saml_assertions (id, expires_at)
+		values ($1, $2)
+		on conflict (id) do nothing
+	`, id, notOnOrAfter)
+	if err != nil {
+		return false, err
+	}
+
+	n, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return n == 0, nil
+}
@@ -2,11 +2,13 @@ package saml
 
 import (
 	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
 	"crypto/x509"
 	"encoding/base64"
+	"encoding/hex"
 	"encoding/xml"
 	"errors"
-	"net/url"
 	"time"
 
 	"github.com/ucarion/dsig"
@@ -30,12 +32,19 @@ const ParamSAMLResponse = "SAMLResponse"
 // writing HTTP handlers that are initiating SAML flows.
 const ParamRelayState = "RelayState"
 
+// ParamSAMLRequest is the name of the URL query parameter a SAML protocol
+// message (an AuthnRequest or a LogoutRequest) is put in when delivered over
+// the HTTP-Redirect binding.
+const ParamSAMLRequest = "SAMLRequest"
+
 // ErrResponseNotSigned indicates that the SAML response was not signed.
 //
 // Verify does not support handling unsigned SAML responses. Note that some
-// Identity Providers support signing either the full SAML response, or only the
-// SAML assertion: Verify only supports having the full SAML response signed,
-// and will ignore any additional interior signatures.
+// Identity Providers support signing either the full SAML response, or only
+// the SAML assertion: Verify only supports having the full SAML response
+// signed, and will ignore any additional interior signatures. To accept a
+// response whose assertion (rather than the response itself) is signed, use
+// VerifyWithOptions with AllowAssertionSignature set.
 var ErrResponseNotSigned = errors.New("saml: response not signed")
 
 // ErrAssertionExpired indicates that the SAML response is expired, or not yet
@@ -57,6 +66,122 @@ var ErrInvalidIssuer = errors.New("saml: invalid issuer")
 // assertion meant for a different service provider.
 var ErrInvalidRecipient = errors.New("saml: invalid recipient")
 
+// ErrInvalidInResponseTo indicates that the SAML response's InResponseTo
+// attribute did not match the ID of an outstanding, SP-initiated
+// AuthnRequest.
+//
+// By default, VerifyWithOptions rejects unsolicited (IdP-initiated)
+// responses: this error is also returned when the response has no
+// InResponseTo at all and VerifyOptions.AllowIdPInitiated is not set. This
+// guards against an attacker replaying an IdP-initiated response against a
+// user who never initiated a login.
+var ErrInvalidInResponseTo = errors.New("saml: invalid InResponseTo")
+
+// ErrInvalidDestination indicates that the SAML response's Destination
+// attribute did not match the recipient ACS URL.
+var ErrInvalidDestination = errors.New("saml: invalid destination")
+
+// ErrAssertionEncrypted indicates that a response carried an
+// EncryptedAssertion but VerifyOptions.DecryptionKey was not set, so the
+// assertion could not be decrypted.
+var ErrAssertionEncrypted = errors.New("saml: assertion is encrypted, but no decryption key was given")
+
+// ErrAssertionNotSigned indicates that neither the response nor its assertion
+// was signed.
+var ErrAssertionNotSigned = errors.New("saml: neither response nor assertion is signed")
+
+// ErrInvalidAudience indicates that VerifyOptions.ExpectedAudience was set,
+// but the assertion's AudienceRestrictions did not contain it.
+//
+// The SAML core spec requires a service provider to reject any assertion
+// whose audiences it doesn't recognize, so a missing or empty
+// AudienceRestrictions is treated the same as one that doesn't list the
+// expected audience.
+var ErrInvalidAudience = errors.New("saml: invalid audience")
+
+// ErrNoCerts indicates that VerifyWithCerts was called without any
+// certificates to check the response's signature against.
+var ErrNoCerts = errors.New("saml: no certificates given to verify against")
+
+// verifyAnyCert calls verify once per cert in certs, in order, and returns
+// nil as soon as one succeeds. If none succeed, it returns the last error
+// verify returned.
+func verifyAnyCert(certs []*x509.Certificate, verify func(cert *x509.Certificate) error) error {
+	if len(certs) == 0 {
+		return ErrNoCerts
+	}
+
+	var err error
+	for _, cert := range certs {
+		if err = verify(cert); err == nil {
+			return nil
+		}
+	}
+
+	return err
+}
+
+// NewRequestID generates a random identifier suitable for use as the ID of an
+// AuthnRequest.
+//
+// The returned ID is a random 160-bit value, hex-encoded and prefixed with an
+// underscore so that it's a valid XSD NCName (IDs in SAML, being XSD IDs,
+// cannot start with a digit). Callers implementing an SP-initiated flow
+// should stash the returned ID (typically in RelayState or server-side
+// session state) and later pass it as VerifyOptions.ExpectedRequestID.
+func NewRequestID() (string, error) {
+	b := make([]byte, 20)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	return "_" + hex.EncodeToString(b), nil
+}
+
+// VerifyOptions customizes the behavior of VerifyWithOptions.
+type VerifyOptions struct {
+	// ExpectedRequestID is the ID of the AuthnRequest this response is
+	// expected to be in response to, as previously returned by NewRequestID.
+	// If set, VerifyWithOptions requires the response's InResponseTo (on both
+	// the top-level Response and its SubjectConfirmationData) to match this
+	// value, and returns ErrInvalidInResponseTo otherwise.
+	ExpectedRequestID string
+
+	// AllowIdPInitiated allows responses with no InResponseTo at all, i.e.
+	// responses to an IdP-initiated login rather than one this service
+	// provider asked for. It has no effect if ExpectedRequestID is set.
+	//
+	// Unsolicited responses are rejected by default, since allowing them
+	// makes it possible for an attacker to replay a signed response intended
+	// for IdP-initiated login against a victim who never initiated one.
+	AllowIdPInitiated bool
+
+	// AllowAssertionSignature allows a response whose outer Response element
+	// is unsigned, provided its Assertion element is itself signed. Several
+	// IdPs (ADFS, Okta, Shibboleth among them) sign only the assertion rather
+	// than the whole response.
+	AllowAssertionSignature bool
+
+	// DecryptionKey is the service provider's private key, used to decrypt a
+	// response's EncryptedAssertion when present. If a response carries an
+	// EncryptedAssertion and DecryptionKey is nil, VerifyWithOptions returns
+	// ErrAssertionEncrypted.
+	DecryptionKey *rsa.PrivateKey
+
+	// ExpectedAudience, if set, is the service provider's entity ID, which
+	// must appear among the assertion's AudienceRestrictions. It's often
+	// distinct from recipient, which is the ACS URL. If set and the
+	// assertion doesn't list it as an audience, VerifyWithOptions returns
+	// ErrInvalidAudience.
+	ExpectedAudience string
+
+	// ClockSkew is how far this server's clock is allowed to disagree with
+	// the IdP's when checking NotBefore/NotOnOrAfter: NotBefore is relaxed
+	// by -ClockSkew, and NotOnOrAfter by +ClockSkew. It defaults to zero,
+	// i.e. no tolerance.
+	ClockSkew time.Duration
+}
+
 // Verify parses and verifies a SAML response.
 //
 // samlResponse should be the HTTP POST body parameter. Consider using
@@ -79,7 +204,31 @@ var ErrInvalidRecipient = errors.New("saml: invalid recipient")
 // ErrAssertionExpired.
 //
 // Verify does not check if cert is expired.
+//
+// Verify allows unsolicited, IdP-initiated responses. To enforce that a
+// response is in reply to a specific SP-initiated AuthnRequest, use
+// VerifyWithOptions with ExpectedRequestID set.
 func Verify(samlResponse, issuer string, cert *x509.Certificate, recipient string, now time.Time) (Response, error) {
+	return VerifyWithOptions(samlResponse, issuer, cert, recipient, now, VerifyOptions{AllowIdPInitiated: true})
+}
+
+// VerifyWithOptions parses and verifies a SAML response, like Verify, but
+// enforces InResponseTo, and the other checks and allowances, per opts.
+//
+// See Verify for the meaning of samlResponse, issuer, cert, recipient, and
+// now. recipient is also used as the expected Destination, here and in
+// Verify alike.
+func VerifyWithOptions(samlResponse, issuer string, cert *x509.Certificate, recipient string, now time.Time, opts VerifyOptions) (Response, error) {
+	return VerifyWithCerts(samlResponse, issuer, []*x509.Certificate{cert}, recipient, now, opts)
+}
+
+// VerifyWithCerts is like VerifyWithOptions, but accepts every certificate an
+// IdP currently has on file (e.g. IDPSSODescriptor.SigningCertificates)
+// rather than a single cert, and succeeds if the response was signed by any
+// one of them. This allows an IdP to roll its signing key over without
+// downtime: during the rollover, its metadata lists both the old and new
+// certificates, and certs should too.
+func VerifyWithCerts(samlResponse, issuer string, certs []*x509.Certificate, recipient string, now time.Time, opts VerifyOptions) (Response, error) {
 	data, err := base64.StdEncoding.DecodeString(samlResponse)
 	if err != nil {
 		return Response{}, err
@@ -90,13 +239,48 @@ func Verify(samlResponse, issuer string, cert *x509.Certificate, recipient strin
 		return Response{}, err
 	}
 
-	if response.Signature.SignatureValue == "" {
-		return Response{}, ErrResponseNotSigned
+	// assertionData is the XML bytes containing the Assertion element that
+	// ends up in response.Assertion. Ordinarily that's just data, since the
+	// Assertion is inline in the response, but if the response instead
+	// carried an EncryptedAssertion, it's the decrypted plaintext.
+	assertionData := data
+	if response.EncryptedAssertion != nil {
+		if opts.DecryptionKey == nil {
+			return Response{}, ErrAssertionEncrypted
+		}
+
+		decrypted, err := decryptAssertion(*response.EncryptedAssertion, opts.DecryptionKey)
+		if err != nil {
+			return Response{}, err
+		}
+
+		if err := xml.Unmarshal(decrypted, &response.Assertion); err != nil {
+			return Response{}, err
+		}
+
+		assertionData = decrypted
 	}
 
-	decoder := xml.NewDecoder(bytes.NewReader(data))
-	if err := response.Signature.Verify(cert, decoder); err != nil {
-		return Response{}, err
+	if response.Signature.SignatureValue == "" {
+		if !opts.AllowAssertionSignature {
+			return Response{}, ErrResponseNotSigned
+		}
+
+		if response.Assertion.Signature.SignatureValue == "" {
+			return Response{}, ErrAssertionNotSigned
+		}
+
+		if err := verifyAnyCert(certs, func(cert *x509.Certificate) error {
+			return response.Assertion.Signature.Verify(cert, xml.NewDecoder(bytes.NewReader(assertionData)))
+		}); err != nil {
+			return Response{}, err
+		}
+	} else {
+		if err := verifyAnyCert(certs, func(cert *x509.Certificate) error {
+			return response.Signature.Verify(cert, xml.NewDecoder(bytes.NewReader(data)))
+		}); err != nil {
+			return Response{}, err
+		}
 	}
 
 	if response.Assertion.Issuer.Name != issuer {
@@ -107,15 +291,45 @@ func Verify(samlResponse, issuer string, cert *x509.Certificate, recipient strin
 		return Response{}, ErrInvalidRecipient
 	}
 
-	if now.Before(response.Assertion.Conditions.NotBefore) {
+	if response.Destination != "" && response.Destination != recipient {
+		return Response{}, ErrInvalidDestination
+	}
+
+	if opts.ExpectedRequestID != "" {
+		if response.InResponseTo != opts.ExpectedRequestID {
+			return Response{}, ErrInvalidInResponseTo
+		}
+
+		if scd := response.Assertion.Subject.SubjectConfirmation.SubjectConfirmationData; scd.InResponseTo != opts.ExpectedRequestID {
+			return Response{}, ErrInvalidInResponseTo
+		}
+	} else if !opts.AllowIdPInitiated {
+		return Response{}, ErrInvalidInResponseTo
+	}
+
+	if opts.ExpectedAudience != "" {
+		found := false
+		for _, audience := range response.Assertion.Conditions.AudienceRestrictions {
+			if audience == opts.ExpectedAudience {
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			return Response{}, ErrInvalidAudience
+		}
+	}
+
+	if now.Before(response.Assertion.Conditions.NotBefore.Add(-opts.ClockSkew)) {
 		return Response{}, ErrAssertionExpired
 	}
 
-	if now.After(response.Assertion.Conditions.NotOnOrAfter) {
+	if now.After(response.Assertion.Conditions.NotOnOrAfter.Add(opts.ClockSkew)) {
 		return Response{}, ErrAssertionExpired
 	}
 
-	if now.After(response.Assertion.Subject.SubjectConfirmation.SubjectConfirmationData.NotOnOrAfter) {
+	if now.After(response.Assertion.Subject.SubjectConfirmation.SubjectConfirmationData.NotOnOrAfter.Add(opts.ClockSkew)) {
 		return Response{}, ErrAssertionExpired
 	}
 
@@ -126,9 +340,12 @@ func Verify(samlResponse, issuer string, cert *x509.Certificate, recipient strin
 //
 // Verify can construct and verify a Response from an HTTP body parameter.
 type Response struct {
-	XMLName   xml.Name       `xml:"urn:oasis:names:tc:SAML:2.0:protocol Response"`
-	Signature dsig.Signature `xml:"Signature"`
-	Assertion Assertion      `xml:"Assertion"`
+	XMLName            xml.Name            `xml:"urn:oasis:names:tc:SAML:2.0:protocol Response"`
+	InResponseTo       string              `xml:"InResponseTo,attr"`
+	Destination        string              `xml:"Destination,attr"`
+	Signature          dsig.Signature      `xml:"Signature"`
+	Assertion          Assertion           `xml:"Assertion"`
+	EncryptedAssertion *EncryptedAssertion `xml:"EncryptedAssertion"`
 }
 
 // Assertion represents a SAML assertion.
@@ -138,12 +355,28 @@ type Response struct {
 // usually information about a particular user, called a subject.
 type Assertion struct {
 	XMLName            xml.Name           `xml:"urn:oasis:names:tc:SAML:2.0:assertion Assertion"`
+	ID                 string             `xml:"ID,attr"`
 	Issuer             Issuer             `xml:"Issuer"`
+	Signature          dsig.Signature     `xml:"Signature"`
 	Subject            Subject            `xml:"Subject"`
 	Conditions         Conditions         `xml:"Conditions"`
+	AuthnStatement     AuthnStatement     `xml:"AuthnStatement"`
 	AttributeStatement AttributeStatement `xml:"AttributeStatement"`
 }
 
+// AuthnStatement describes the circumstances under which a subject was
+// authenticated.
+//
+// SessionIndex identifies the IdP-side session the assertion was issued
+// for; an SP that wants to support Single Logout should stash it alongside
+// its own local session, to later match against a LogoutRequest's
+// SessionIndex.
+type AuthnStatement struct {
+	XMLName      xml.Name  `xml:"urn:oasis:names:tc:SAML:2.0:assertion AuthnStatement"`
+	AuthnInstant time.Time `xml:"AuthnInstant,attr"`
+	SessionIndex string    `xml:"SessionIndex,attr,omitempty"`
+}
+
 // Issuer indicates the entity that issued a SAML assertion.
 type Issuer struct {
 	XMLName xml.Name `xml:"urn:oasis:names:tc:SAML:2.0:assertion Issuer"`
@@ -176,6 +409,7 @@ type SubjectConfirmation struct {
 // valid.
 type SubjectConfirmationData struct {
 	XMLName      xml.Name  `xml:"urn:oasis:names:tc:SAML:2.0:assertion SubjectConfirmationData"`
+	InResponseTo string    `xml:"InResponseTo,attr"`
 	NotOnOrAfter time.Time `xml:"NotOnOrAfter,attr"`
 	Recipient    string    `xml:"Recipient,attr"`
 }
@@ -183,9 +417,10 @@ type SubjectConfirmationData struct {
 // Conditions is a set of constraints that limit under what conditions an
 // assertion is valid.
 type Conditions struct {
-	XMLName      xml.Name  `xml:"urn:oasis:names:tc:SAML:2.0:assertion Conditions"`
-	NotBefore    time.Time `xml:"NotBefore,attr"`
-	NotOnOrAfter time.Time `xml:"NotOnOrAfter,attr"`
+	XMLName              xml.Name  `xml:"urn:oasis:names:tc:SAML:2.0:assertion Conditions"`
+	NotBefore            time.Time `xml:"NotBefore,attr"`
+	NotOnOrAfter         time.Time `xml:"NotOnOrAfter,attr"`
+	AudienceRestrictions []string  `xml:"AudienceRestriction>Audience"`
 }
 
 // AttributeStatement is a set of user attributes.
@@ -194,95 +429,27 @@ type AttributeStatement struct {
 	Attributes []Attribute `xml:"Attribute"`
 }
 
-// Attribute is a particular key-value attribute of the user in an assertion.
+// Attribute is a particular attribute of the user in an assertion. An
+// attribute may carry more than one value, e.g. a group membership
+// attribute listing every group a user belongs to.
 type Attribute struct {
-	XMLName    xml.Name `xml:"urn:oasis:names:tc:SAML:2.0:assertion Attribute"`
-	Name       string   `xml:"Name,attr"`
-	NameFormat string   `xml:"NameFormat,attr"`
-	Value      string   `xml:"AttributeValue"`
-}
-
-// EntityDescriptor describes a SAML entity. This is often referred to as
-// "metadata".
-//
-// This struct is meant to store "Identity Provider metadata"; it's meant to
-// store the description of a SAML Identity Provider.
-type EntityDescriptor struct {
-	XMLName          xml.Name         `xml:"urn:oasis:names:tc:SAML:2.0:metadata EntityDescriptor"`
-	EntityID         string           `xml:"entityID,attr"`
-	IDPSSODescriptor IDPSSODescriptor `xml:"IDPSSODescriptor"`
+	XMLName      xml.Name `xml:"urn:oasis:names:tc:SAML:2.0:assertion Attribute"`
+	Name         string   `xml:"Name,attr"`
+	FriendlyName string   `xml:"FriendlyName,attr"`
+	NameFormat   string   `xml:"NameFormat,attr"`
+	Values       []string `xml:"AttributeValue"`
 }
 
-// ErrNoRedirectBinding indicates that an EntityDescriptor did not declare an
-// HTTP-Redirect binding.
-var ErrNoRedirectBinding = errors.New("saml: no HTTP redirect binding in IdP metadata")
-
-// SingleSignOnServiceBindingHTTPRedirect is the URI for a SAML HTTP-Redirect
-// Binding.
-const SingleSignOnServiceBindingHTTPRedirect = "urn:oasis:names:tc:SAML:2.0:bindings:HTTP-Redirect"
-
-// GetEntityIDCertificateAndRedirectURL extracts an issuer entity ID, a x509
-// certificate, and a redirect URL from a set of Identity Provider metadata.
-//
-// Returns an error if the x509 certificate or redirect URL are malformed. If
-// there is no redirect URL at all, returns ErrNoRedirectBinding.
-func (d *EntityDescriptor) GetEntityIDCertificateAndRedirectURL() (string, *x509.Certificate, *url.URL, error) {
-	asn1Data, err := base64.StdEncoding.DecodeString(d.IDPSSODescriptor.KeyDescriptor.KeyInfo.X509Data.X509Certificate.Value)
-	if err != nil {
-		return "", nil, nil, err
-	}
-
-	cert, err := x509.ParseCertificate(asn1Data)
-	if err != nil {
-		return "", nil, nil, err
-	}
-
-	for _, s := range d.IDPSSODescriptor.SingleSignOnServices {
-		if s.Binding == SingleSignOnServiceBindingHTTPRedirect {
-			location, err := url.Parse(s.Location)
-			return d.EntityID, cert, location, err
+// Attribute returns the values of the assertion's attribute matching name,
+// checked against both Attribute.Name and Attribute.FriendlyName (IdPs
+// vary in which one they expect a caller to look up by). If no attribute
+// matches, it returns nil.
+func (a *Assertion) Attribute(name string) []string {
+	for _, attr := range a.AttributeStatement.Attributes {
+		if attr.Name == name || attr.FriendlyName == name {
+			return attr.Values
 		}
 	}
 
-	return "", nil, nil, ErrNoRedirectBinding
-}
-
-// IDPSSODescriptor describes the single-sign-on offerings of an identity
-// provider.
-type IDPSSODescriptor struct {
-	XMLName              xml.Name              `xml:"urn:oasis:names:tc:SAML:2.0:metadata IDPSSODescriptor"`
-	KeyDescriptor        KeyDescriptor         `xml:"KeyDescriptor"`
-	SingleSignOnServices []SingleSignOnService `xml:"SingleSignOnService"`
-}
-
-// KeyDescriptor describes the key an identity provider uses to sign data.
-type KeyDescriptor struct {
-	XMLName xml.Name `xml:"urn:oasis:names:tc:SAML:2.0:metadata KeyDescriptor"`
-	KeyInfo KeyInfo  `xml:"KeyInfo"`
-}
-
-// KeyInfo is a XML-DSig description of a x509 key.
-type KeyInfo struct {
-	XMLName  xml.Name `xml:"http://www.w3.org/2000/09/xmldsig# KeyInfo"`
-	X509Data X509Data `xml:"X509Data"`
-}
-
-// X509Data contains an x509 certificate.
-type X509Data struct {
-	XMLName         xml.Name        `xml:"http://www.w3.org/2000/09/xmldsig# X509Data"`
-	X509Certificate X509Certificate `xml:"X509Certificate"`
-}
-
-// X509Certificate contains the base64-encoded ASN.1 data of a x509 certificate.
-type X509Certificate struct {
-	XMLName xml.Name `xml:"http://www.w3.org/2000/09/xmldsig# X509Certificate"`
-	Value   string   `xml:",chardata"`
-}
-
-// SingleSignOnService describes a single binding of an identity provider, and
-// the URL where it can be reached.
-type SingleSignOnService struct {
-	XMLName  xml.Name `xml:"urn:oasis:names:tc:SAML:2.0:metadata SingleSignOnService"`
-	Binding  string   `xml:"Binding,attr"`
-	Location string   `xml:"Location,attr"`
+	return nil
 }
@@ -0,0 +1,112 @@
+package saml
+
+import (
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/xml"
+)
+
+// ProtocolSupportEnumerationSAML20 is the URI service providers declare in
+// their metadata's protocolSupportEnumeration attribute to say they speak
+// SAML 2.0.
+const ProtocolSupportEnumerationSAML20 = "urn:oasis:names:tc:SAML:2.0:protocol"
+
+// NameIDFormatUnspecified is the URI for the "unspecified" NameID format,
+// which lets an IdP send back whatever identifier it likes (an email
+// address, a username, an opaque ID, etc).
+const NameIDFormatUnspecified = "urn:oasis:names:tc:SAML:1.1:nameid-format:unspecified"
+
+// SPEntityDescriptor describes a SAML service provider. This is the
+// "Service Provider metadata" counterpart to EntityDescriptor, which
+// describes an identity provider.
+//
+// BuildSPMetadata constructs one and marshals it to XML; an IdP like Okta,
+// ADFS, or Shibboleth can ingest that XML to auto-configure its side of the
+// integration.
+type SPEntityDescriptor struct {
+	XMLName         xml.Name        `xml:"urn:oasis:names:tc:SAML:2.0:metadata EntityDescriptor"`
+	EntityID        string          `xml:"entityID,attr"`
+	SPSSODescriptor SPSSODescriptor `xml:"SPSSODescriptor"`
+}
+
+// SPSSODescriptor describes the single-sign-on offerings of a service
+// provider.
+type SPSSODescriptor struct {
+	XMLName                    xml.Name                   `xml:"urn:oasis:names:tc:SAML:2.0:metadata SPSSODescriptor"`
+	AuthnRequestsSigned        bool                       `xml:"AuthnRequestsSigned,attr"`
+	WantAssertionsSigned       bool                       `xml:"WantAssertionsSigned,attr"`
+	ProtocolSupportEnumeration string                     `xml:"protocolSupportEnumeration,attr"`
+	KeyDescriptors             []KeyDescriptor            `xml:"KeyDescriptor"`
+	NameIDFormats              []string                   `xml:"NameIDFormat"`
+	AssertionConsumerServices  []AssertionConsumerService `xml:"AssertionConsumerService"`
+}
+
+// AssertionConsumerService describes a single endpoint a service provider
+// wants IdP responses delivered to, and the binding it expects them over.
+type AssertionConsumerService struct {
+	XMLName  xml.Name `xml:"urn:oasis:names:tc:SAML:2.0:metadata AssertionConsumerService"`
+	Binding  string   `xml:"Binding,attr"`
+	Location string   `xml:"Location,attr"`
+	Index    int      `xml:"index,attr"`
+}
+
+// BuildSPMetadata builds a spec-compliant SAML service provider metadata
+// document for an SP whose entity ID is entityID, and whose ACS endpoint
+// (reachable over the HTTP-POST binding) is acsURL.
+//
+// signingCert and encryptionCert, if given, are advertised as KeyDescriptors
+// with use="signing" and use="encryption" respectively, so the IdP can
+// validate signed AuthnRequests and encrypt assertions to this SP; either
+// may be nil if this SP doesn't sign requests, or doesn't want encrypted
+// assertions. wantAssertionsSigned is advertised via the
+// WantAssertionsSigned attribute, telling the IdP whether this SP requires
+// assertions to be signed.
+//
+// The returned document unmarshals back into an SPEntityDescriptor with
+// xml.Unmarshal, the same way IdP metadata unmarshals into an
+// EntityDescriptor. EntityDescriptor itself reads only an
+// IDPSSODescriptor, so it does not parse this document's SPSSODescriptor.
+func BuildSPMetadata(entityID, acsURL string, signingCert, encryptionCert *x509.Certificate, wantAssertionsSigned bool) ([]byte, error) {
+	var keyDescriptors []KeyDescriptor
+	if signingCert != nil {
+		keyDescriptors = append(keyDescriptors, newKeyDescriptor(KeyDescriptorUseSigning, signingCert))
+	}
+
+	if encryptionCert != nil {
+		keyDescriptors = append(keyDescriptors, newKeyDescriptor(KeyDescriptorUseEncryption, encryptionCert))
+	}
+
+	descriptor := SPEntityDescriptor{
+		EntityID: entityID,
+		SPSSODescriptor: SPSSODescriptor{
+			AuthnRequestsSigned:        signingCert != nil,
+			WantAssertionsSigned:       wantAssertionsSigned,
+			ProtocolSupportEnumeration: ProtocolSupportEnumerationSAML20,
+			KeyDescriptors:             keyDescriptors,
+			NameIDFormats:              []string{NameIDFormatUnspecified},
+			AssertionConsumerServices: []AssertionConsumerService{
+				{Binding: SingleSignOnServiceBindingHTTPPOST, Location: acsURL, Index: 0},
+			},
+		},
+	}
+
+	data, err := xml.MarshalIndent(descriptor, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+
+	return append([]byte(xml.Header), data...), nil
+}
+
+func newKeyDescriptor(use string, cert *x509.Certificate) KeyDescriptor {
+	return KeyDescriptor{
+		Use: use,
+		KeyInfo: KeyInfo{
+			X509Data: X509Data{
+				X509Certificate: X509Certificate{
+					Value: base64.StdEncoding.EncodeToString(cert.Raw),
+				},
+			},
+		},
+	}
+}
@@ -0,0 +1,213 @@
+package saml
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+)
+
+// ErrUnsupportedEncryptionAlgorithm indicates that an EncryptedAssertion used
+// a key-transport or block-cipher algorithm this package doesn't implement.
+var ErrUnsupportedEncryptionAlgorithm = errors.New("saml: unsupported XML encryption algorithm")
+
+// ErrAssertionDecryptionFailed indicates that an EncryptedAssertion could not
+// be decrypted.
+//
+// This is returned in place of the underlying cause (a malformed key or
+// ciphertext, a failed RSA unwrap, or invalid padding) on purpose: those
+// failures are otherwise distinguishable from one another, which would let
+// an attacker who can submit arbitrary ciphertext to an endpoint using this
+// package learn something about the plaintext or key from which error comes
+// back, a Vaudenay-style padding oracle against the underlying CBC
+// encryption. Callers should surface this error to users verbatim, and
+// never the error it replaces.
+var ErrAssertionDecryptionFailed = errors.New("saml: failed to decrypt assertion")
+
+// xmlEncNamespace is the XML Encryption Syntax and Processing namespace.
+const xmlEncNamespace = "http://www.w3.org/2001/04/xmlenc#"
+
+// xmlEnc11Namespace is the XML Encryption Syntax and Processing Version 1.1
+// namespace, which added AES-GCM.
+const xmlEnc11Namespace = "http://www.w3.org/2009/xmlenc11#"
+
+// rsaOAEPMGF1P and rsa15 are the algorithm URIs for the key-transport
+// algorithms this package supports: RSAES-OAEP (with the default SHA-1
+// digest and mask generation function) and RSAES-PKCS1-v1_5.
+const (
+	rsaOAEPMGF1P = xmlEncNamespace + "rsa-oaep-mgf1p"
+	rsa15        = xmlEncNamespace + "rsa-1_5"
+)
+
+// aes128CBC, aes256CBC, aes128GCM, aes192GCM, and aes256GCM are the
+// algorithm URIs for the block-cipher algorithms this package supports, as
+// used to encrypt the assertion itself.
+const (
+	aes128CBC = xmlEncNamespace + "aes128-cbc"
+	aes256CBC = xmlEncNamespace + "aes256-cbc"
+
+	aes128GCM = xmlEnc11Namespace + "aes128-gcm"
+	aes192GCM = xmlEnc11Namespace + "aes192-gcm"
+	aes256GCM = xmlEnc11Namespace + "aes256-gcm"
+)
+
+// EncryptedAssertion represents a SAML assertion encrypted per the XML
+// Encryption Syntax and Processing (XML-Enc) specification.
+//
+// IdPs such as Azure AD, ADFS, and PingFederate send an EncryptedAssertion in
+// place of a plaintext Assertion. VerifyWithOptions, given a DecryptionKey,
+// decrypts it transparently.
+type EncryptedAssertion struct {
+	XMLName       xml.Name      `xml:"urn:oasis:names:tc:SAML:2.0:assertion EncryptedAssertion"`
+	EncryptedData EncryptedData `xml:"http://www.w3.org/2001/04/xmlenc# EncryptedData"`
+}
+
+// EncryptedData holds the encrypted assertion ciphertext, the symmetric
+// algorithm it was encrypted with, and the wrapped key needed to decrypt it.
+type EncryptedData struct {
+	XMLName          xml.Name         `xml:"http://www.w3.org/2001/04/xmlenc# EncryptedData"`
+	EncryptionMethod EncryptionMethod `xml:"EncryptionMethod"`
+	EncryptedKey     EncryptedKey     `xml:"KeyInfo>EncryptedKey"`
+	CipherData       CipherData       `xml:"CipherData"`
+}
+
+// EncryptedKey holds the content-encryption key, itself encrypted ("wrapped")
+// to the service provider's public key.
+type EncryptedKey struct {
+	XMLName          xml.Name         `xml:"http://www.w3.org/2001/04/xmlenc# EncryptedKey"`
+	EncryptionMethod EncryptionMethod `xml:"EncryptionMethod"`
+	CipherData       CipherData       `xml:"CipherData"`
+}
+
+// EncryptionMethod identifies the algorithm used for a key-transport or
+// block-cipher encryption step, by URI.
+type EncryptionMethod struct {
+	Algorithm string `xml:"Algorithm,attr"`
+}
+
+// CipherData holds base64-encoded ciphertext.
+type CipherData struct {
+	CipherValue string `xml:"CipherValue"`
+}
+
+// decryptAssertion recovers the plaintext Assertion XML from an
+// EncryptedAssertion, given the service provider's RSA private key.
+//
+// It unwraps the content-encryption key (via RSA-OAEP or RSAES-PKCS1-v1_5),
+// then uses it to decrypt the assertion ciphertext (via AES-CBC or
+// AES-GCM), per whichever algorithms the IdP declared. For AES-CBC, the IV
+// is expected as the first block of the ciphertext, and the plaintext is
+// expected to be PKCS#7 padded; for AES-GCM, the nonce is expected as the
+// first GCM.NonceSize bytes, as XML-Enc requires in each case.
+//
+// An algorithm URI it doesn't implement, for either step, is reported as
+// ErrUnsupportedEncryptionAlgorithm. Every other failure, for either step,
+// is reported as ErrAssertionDecryptionFailed rather than the underlying
+// cause: see that error's doc comment for why.
+func decryptAssertion(ea EncryptedAssertion, key *rsa.PrivateKey) ([]byte, error) {
+	wrappedKey, err := base64.StdEncoding.DecodeString(ea.EncryptedData.EncryptedKey.CipherData.CipherValue)
+	if err != nil {
+		return nil, ErrAssertionDecryptionFailed
+	}
+
+	var cek []byte
+	switch ea.EncryptedData.EncryptedKey.EncryptionMethod.Algorithm {
+	case rsaOAEPMGF1P:
+		cek, err = rsa.DecryptOAEP(sha1.New(), rand.Reader, key, wrappedKey, nil)
+	case rsa15:
+		cek, err = rsa.DecryptPKCS1v15(rand.Reader, key, wrappedKey)
+	default:
+		return nil, ErrUnsupportedEncryptionAlgorithm
+	}
+	if err != nil {
+		return nil, ErrAssertionDecryptionFailed
+	}
+
+	ciphertext, err := base64.StdEncoding.DecodeString(ea.EncryptedData.CipherData.CipherValue)
+	if err != nil {
+		return nil, ErrAssertionDecryptionFailed
+	}
+
+	switch ea.EncryptedData.EncryptionMethod.Algorithm {
+	case aes128CBC, aes256CBC:
+		return decryptAESCBC(cek, ciphertext)
+	case aes128GCM, aes192GCM, aes256GCM:
+		return decryptAESGCM(cek, ciphertext)
+	default:
+		return nil, ErrUnsupportedEncryptionAlgorithm
+	}
+}
+
+// decryptAESCBC decrypts ciphertext (an IV followed by PKCS#7-padded
+// blocks, as XML-Enc's AES-CBC encoding requires) with the content-
+// encryption key cek.
+func decryptAESCBC(cek, ciphertext []byte) ([]byte, error) {
+	block, err := aes.NewCipher(cek)
+	if err != nil {
+		return nil, ErrAssertionDecryptionFailed
+	}
+
+	if len(ciphertext) < aes.BlockSize || len(ciphertext)%aes.BlockSize != 0 {
+		return nil, ErrAssertionDecryptionFailed
+	}
+
+	iv, ciphertext := ciphertext[:aes.BlockSize], ciphertext[aes.BlockSize:]
+	if len(ciphertext) == 0 {
+		return nil, ErrAssertionDecryptionFailed
+	}
+
+	plaintext := make([]byte, len(ciphertext))
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(plaintext, ciphertext)
+
+	plaintext, err = pkcs7Unpad(plaintext)
+	if err != nil {
+		return nil, ErrAssertionDecryptionFailed
+	}
+
+	return plaintext, nil
+}
+
+// decryptAESGCM decrypts ciphertext (a nonce followed by the GCM-sealed
+// ciphertext and authentication tag, as XML-Enc 1.1's AES-GCM encoding
+// requires) with the content-encryption key cek.
+func decryptAESGCM(cek, ciphertext []byte) ([]byte, error) {
+	block, err := aes.NewCipher(cek)
+	if err != nil {
+		return nil, ErrAssertionDecryptionFailed
+	}
+
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, ErrAssertionDecryptionFailed
+	}
+
+	if len(ciphertext) < gcm.NonceSize() {
+		return nil, ErrAssertionDecryptionFailed
+	}
+
+	nonce, ciphertext := ciphertext[:gcm.NonceSize()], ciphertext[gcm.NonceSize():]
+	plaintext, err := gcm.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return nil, ErrAssertionDecryptionFailed
+	}
+
+	return plaintext, nil
+}
+
+// pkcs7Unpad removes PKCS#7 padding, as used by XML-Enc's AES-CBC encryption.
+func pkcs7Unpad(b []byte) ([]byte, error) {
+	if len(b) == 0 {
+		return nil, errors.New("saml: empty plaintext")
+	}
+
+	n := int(b[len(b)-1])
+	if n == 0 || n > len(b) {
+		return nil, errors.New("saml: invalid PKCS#7 padding")
+	}
+
+	return b[:len(b)-n], nil
+}
@@ -0,0 +1,227 @@
+package saml
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"encoding/base64"
+	"testing"
+)
+
+func mustGenerateRSAKey(t *testing.T) *rsa.PrivateKey {
+	t.Helper()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return key
+}
+
+func wrapKeyOAEP(t *testing.T, pub *rsa.PublicKey, cek []byte) string {
+	t.Helper()
+
+	wrapped, err := rsa.EncryptOAEP(sha1.New(), rand.Reader, pub, cek, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return base64.StdEncoding.EncodeToString(wrapped)
+}
+
+func wrapKeyPKCS1v15(t *testing.T, pub *rsa.PublicKey, cek []byte) string {
+	t.Helper()
+
+	wrapped, err := rsa.EncryptPKCS1v15(rand.Reader, pub, cek)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return base64.StdEncoding.EncodeToString(wrapped)
+}
+
+func encryptCBC(t *testing.T, cek, plaintext []byte) string {
+	t.Helper()
+
+	block, err := aes.NewCipher(cek)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	padded := pkcs7Pad(plaintext, aes.BlockSize)
+
+	iv := make([]byte, aes.BlockSize)
+	ciphertext := make([]byte, len(padded))
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(ciphertext, padded)
+
+	return base64.StdEncoding.EncodeToString(append(iv, ciphertext...))
+}
+
+func encryptGCM(t *testing.T, cek, plaintext []byte) string {
+	t.Helper()
+
+	block, err := aes.NewCipher(cek)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	sealed := gcm.Seal(nil, nonce, plaintext, nil)
+
+	return base64.StdEncoding.EncodeToString(append(nonce, sealed...))
+}
+
+func pkcs7Pad(b []byte, blockSize int) []byte {
+	n := blockSize - len(b)%blockSize
+	padding := make([]byte, n)
+	for i := range padding {
+		padding[i] = byte(n)
+	}
+
+	return append(append([]byte{}, b...), padding...)
+}
+
+func TestDecryptAssertion(t *testing.T) {
+	key := mustGenerateRSAKey(t)
+	plaintext := []byte("<Assertion>hello</Assertion>")
+
+	cases := []struct {
+		name        string
+		keyAlg      string
+		wrapKey     func(t *testing.T, pub *rsa.PublicKey, cek []byte) string
+		dataAlg     string
+		encryptData func(t *testing.T, cek, plaintext []byte) string
+		cekSize     int
+	}{
+		{"RSA-OAEP + AES-128-CBC", rsaOAEPMGF1P, wrapKeyOAEP, aes128CBC, encryptCBC, 16},
+		{"RSA-OAEP + AES-256-CBC", rsaOAEPMGF1P, wrapKeyOAEP, aes256CBC, encryptCBC, 32},
+		{"RSA-1_5 + AES-128-CBC", rsa15, wrapKeyPKCS1v15, aes128CBC, encryptCBC, 16},
+		{"RSA-OAEP + AES-128-GCM", rsaOAEPMGF1P, wrapKeyOAEP, aes128GCM, encryptGCM, 16},
+		{"RSA-1_5 + AES-256-GCM", rsa15, wrapKeyPKCS1v15, aes256GCM, encryptGCM, 32},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			cek := make([]byte, c.cekSize)
+			if _, err := rand.Read(cek); err != nil {
+				t.Fatal(err)
+			}
+
+			ea := EncryptedAssertion{
+				EncryptedData: EncryptedData{
+					EncryptionMethod: EncryptionMethod{Algorithm: c.dataAlg},
+					EncryptedKey: EncryptedKey{
+						EncryptionMethod: EncryptionMethod{Algorithm: c.keyAlg},
+						CipherData:       CipherData{CipherValue: c.wrapKey(t, &key.PublicKey, cek)},
+					},
+					CipherData: CipherData{CipherValue: c.encryptData(t, cek, plaintext)},
+				},
+			}
+
+			got, err := decryptAssertion(ea, key)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if string(got) != string(plaintext) {
+				t.Errorf("got %q, want %q", got, plaintext)
+			}
+		})
+	}
+}
+
+func TestDecryptAssertionErrors(t *testing.T) {
+	key := mustGenerateRSAKey(t)
+	cek := make([]byte, 16)
+	if _, err := rand.Read(cek); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("unsupported key algorithm", func(t *testing.T) {
+		ea := EncryptedAssertion{
+			EncryptedData: EncryptedData{
+				EncryptionMethod: EncryptionMethod{Algorithm: aes128CBC},
+				EncryptedKey: EncryptedKey{
+					EncryptionMethod: EncryptionMethod{Algorithm: "unsupported"},
+					CipherData:       CipherData{CipherValue: wrapKeyOAEP(t, &key.PublicKey, cek)},
+				},
+				CipherData: CipherData{CipherValue: encryptCBC(t, cek, []byte("hi"))},
+			},
+		}
+
+		if _, err := decryptAssertion(ea, key); err != ErrUnsupportedEncryptionAlgorithm {
+			t.Fatalf("err = %v, want ErrUnsupportedEncryptionAlgorithm", err)
+		}
+	})
+
+	t.Run("unsupported data algorithm", func(t *testing.T) {
+		ea := EncryptedAssertion{
+			EncryptedData: EncryptedData{
+				EncryptionMethod: EncryptionMethod{Algorithm: "unsupported"},
+				EncryptedKey: EncryptedKey{
+					EncryptionMethod: EncryptionMethod{Algorithm: rsaOAEPMGF1P},
+					CipherData:       CipherData{CipherValue: wrapKeyOAEP(t, &key.PublicKey, cek)},
+				},
+				CipherData: CipherData{CipherValue: encryptCBC(t, cek, []byte("hi"))},
+			},
+		}
+
+		if _, err := decryptAssertion(ea, key); err != ErrUnsupportedEncryptionAlgorithm {
+			t.Fatalf("err = %v, want ErrUnsupportedEncryptionAlgorithm", err)
+		}
+	})
+
+	t.Run("bad CBC padding", func(t *testing.T) {
+		block, err := aes.NewCipher(cek)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		iv := make([]byte, aes.BlockSize)
+		badPlaintext := make([]byte, aes.BlockSize)
+		badPlaintext[aes.BlockSize-1] = 0xff // invalid padding length
+
+		ciphertext := make([]byte, aes.BlockSize)
+		cipher.NewCBCEncrypter(block, iv).CryptBlocks(ciphertext, badPlaintext)
+
+		ea := EncryptedAssertion{
+			EncryptedData: EncryptedData{
+				EncryptionMethod: EncryptionMethod{Algorithm: aes128CBC},
+				EncryptedKey: EncryptedKey{
+					EncryptionMethod: EncryptionMethod{Algorithm: rsaOAEPMGF1P},
+					CipherData:       CipherData{CipherValue: wrapKeyOAEP(t, &key.PublicKey, cek)},
+				},
+				CipherData: CipherData{CipherValue: base64.StdEncoding.EncodeToString(append(iv, ciphertext...))},
+			},
+		}
+
+		if _, err := decryptAssertion(ea, key); err != ErrAssertionDecryptionFailed {
+			t.Fatalf("err = %v, want ErrAssertionDecryptionFailed", err)
+		}
+	})
+
+	t.Run("malformed ciphertext does not leak a distinguishable error", func(t *testing.T) {
+		ea := EncryptedAssertion{
+			EncryptedData: EncryptedData{
+				EncryptionMethod: EncryptionMethod{Algorithm: aes128CBC},
+				EncryptedKey: EncryptedKey{
+					EncryptionMethod: EncryptionMethod{Algorithm: rsaOAEPMGF1P},
+					CipherData:       CipherData{CipherValue: wrapKeyOAEP(t, &key.PublicKey, cek)},
+				},
+				CipherData: CipherData{CipherValue: base64.StdEncoding.EncodeToString([]byte("short"))},
+			},
+		}
+
+		if _, err := decryptAssertion(ea, key); err != ErrAssertionDecryptionFailed {
+			t.Fatalf("err = %v, want ErrAssertionDecryptionFailed", err)
+		}
+	})
+}